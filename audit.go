@@ -0,0 +1,326 @@
+package accountsync
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/net/context"
+)
+
+const (
+	DriftProfile      = "profile"
+	DriftEmails       = "emails"
+	DriftMemberships  = "memberships"
+	DriftRepositories = "repositories"
+	DriftPermissions  = "permissions"
+)
+
+// DriftCategories lists the categories of an audit in the order they are
+// checked.
+var DriftCategories = []string{
+	DriftProfile,
+	DriftEmails,
+	DriftMemberships,
+	DriftRepositories,
+	DriftPermissions,
+}
+
+// AuditReport lists where the stored state of a user differs from GitHub.
+type AuditReport struct {
+	Login        string
+	Drifts       []*Drift
+	ReposChecked int
+}
+
+// Drift is a single difference between the database and GitHub.
+type Drift struct {
+	Category string
+	Subject  string
+	Detail   string
+}
+
+func (report *AuditReport) add(category, subject, detail string) {
+	report.Drifts = append(report.Drifts, &Drift{Category: category, Subject: subject, Detail: detail})
+}
+
+// InCategory returns the drift found in the given category.
+func (report *AuditReport) InCategory(category string) []*Drift {
+	drifts := []*Drift{}
+	for _, drift := range report.Drifts {
+		if drift.Category == category {
+			drifts = append(drifts, drift)
+		}
+	}
+	return drifts
+}
+
+type storedPermission struct {
+	Permission
+	GithubID sql.NullInt64  `db:"github_id"`
+	Slug     sql.NullString `db:"slug"`
+}
+
+// Audit reads the user with the given login from GitHub and reports where
+// the stored users, emails, memberships, repositories and permissions rows
+// differ from it, without writing anything.
+func (syncer *Syncer) Audit(runCtx context.Context, login string) (*AuditReport, error) {
+	user, client, transport, err := syncer.readOnlyClient(runCtx, login)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AuditReport{Login: login, Drifts: []*Drift{}}
+
+	diff := newSyncDiff(login)
+	err = syncer.diffUserInfo(runCtx, user, client, transport, diff)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, change := range diff.UserFields {
+		report.add(DriftProfile, change.Field,
+			fmt.Sprintf("stored %q, github %q", fmt.Sprint(change.Old), fmt.Sprint(change.New)))
+	}
+	for _, email := range diff.EmailsAdded {
+		report.add(DriftEmails, email, "verified on github, not stored")
+	}
+	for _, email := range diff.EmailsRemoved {
+		report.add(DriftEmails, email, "stored, not verified on github")
+	}
+
+	_, err = syncer.diffOrganizations(runCtx, user, client, diff)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, org := range diff.MembershipsAdded {
+		report.add(DriftMemberships, org, "member on github, no membership stored")
+	}
+	for _, org := range diff.MembershipsRemoved {
+		report.add(DriftMemberships, org, "membership stored, not a member on github")
+	}
+
+	err = syncer.auditRepositories(runCtx, user, client, report)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// auditRepositories compares the repositories visible to the user, and the
+// permissions GitHub reports on them, with the stored rows.
+func (syncer *Syncer) auditRepositories(runCtx context.Context, user *User, client *github.Client, report *AuditReport) error {
+	rs := NewRepositoriesSyncer(syncer.db, syncer.cfg)
+	ctx := &repoSyncContext{
+		runCtx:    runCtx,
+		owner:     &Owner{Type: "user", User: user},
+		user:      user,
+		client:    client,
+		startedAt: time.Now().UTC(),
+		full:      true,
+	}
+
+	// order keeps the GitHub IDs in listing order, for a stable report.
+	order := []int64{}
+	visible := map[int64]bool{}
+	repos := map[int64]*Repository{}
+	perms := map[int64]*Permission{}
+	slugs := map[int64]string{}
+
+	opts := &github.RepositoryListOptions{
+		Type:      "all",
+		Sort:      "full_name",
+		Direction: "asc",
+		ListOptions: github.ListOptions{
+			PerPage: 100,
+			Page:    1,
+		},
+	}
+
+	for {
+		err := contextErr(runCtx)
+		if err != nil {
+			return err
+		}
+
+		ghRepos, response, err := rs.getUserRepositories(opts, ctx)
+		if err != nil {
+			return err
+		}
+
+		for i := range ghRepos {
+			ghRepo := &ghRepos[i]
+			if checkGithubRepo(ghRepo) != nil {
+				continue
+			}
+
+			githubID := int64(*ghRepo.ID)
+			order = append(order, githubID)
+			visible[githubID] = true
+			slugs[githubID] = ghRepo.Slug()
+			if perm := PermissionFromGithubRepository(ghRepo); perm != nil {
+				perms[githubID] = perm
+			}
+
+			if !rs.shouldSync(ghRepo) {
+				continue
+			}
+
+			repo, err := syncer.auditRepo(rs, ghRepo, ctx, report)
+			if err != nil {
+				return err
+			}
+			if repo != nil {
+				repos[githubID] = repo
+			}
+		}
+
+		if response == nil || response.NextPage == 0 {
+			break
+		}
+		opts.ListOptions.Page = response.NextPage
+	}
+
+	report.ReposChecked = len(repos)
+
+	stored := map[int64]*Repository{}
+	if len(repos) > 0 {
+		githubIDs := []int64{}
+		for githubID := range repos {
+			githubIDs = append(githubIDs, githubID)
+		}
+
+		query, args, err := sqlx.In(`SELECT * FROM repositories WHERE github_id IN (?)`, githubIDs)
+		if err != nil {
+			return err
+		}
+
+		rows := []*Repository{}
+		err = syncer.db.Select(&rows, syncer.db.Rebind(query), args...)
+		if err != nil {
+			return err
+		}
+
+		for _, repo := range rows {
+			stored[repo.GithubID.Int64] = repo
+		}
+	}
+
+	for _, githubID := range order {
+		repo, ok := repos[githubID]
+		if !ok {
+			continue
+		}
+
+		storedRepo, ok := stored[githubID]
+		if !ok {
+			report.add(DriftRepositories, slugs[githubID], "visible on github, not stored")
+			continue
+		}
+
+		// the parent of a fork is only read when none is stored
+		if repo.MissesForkParent() {
+			repo.CopyForkParent(storedRepo)
+			if !storedRepo.ParentGithubID.Valid {
+				err := rs.fetchForkParent(repo, ctx)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		fields := repo.DifferingSyncedFields(storedRepo)
+		if len(fields) > 0 {
+			report.add(DriftRepositories, slugs[githubID], "stale: "+strings.Join(fields, ", "))
+		}
+	}
+
+	owned := []*Repository{}
+	err := syncer.db.Select(&owned, `
+		SELECT * FROM repositories
+		WHERE owner_type = 'User' AND owner_id = $1 AND deleted_at IS NULL`, user.ID.Int64)
+	if err != nil {
+		return err
+	}
+
+	for _, repo := range owned {
+		if !visible[repo.GithubID.Int64] {
+			report.add(DriftRepositories, repo.OwnerName.String+"/"+repo.Name.String,
+				"stored as the user's, not visible on github")
+		}
+	}
+
+	storedPerms := []*storedPermission{}
+	err = syncer.db.Select(&storedPerms, `
+		SELECT permissions.*, repositories.github_id,
+		       repositories.owner_name || '/' || repositories.name AS slug
+		FROM permissions
+		JOIN repositories ON repositories.id = permissions.repository_id
+		WHERE permissions.user_id = $1`, user.ID.Int64)
+	if err != nil {
+		return err
+	}
+
+	storedPermsByGithubID := map[int64]*storedPermission{}
+	for _, perm := range storedPerms {
+		storedPermsByGithubID[perm.GithubID.Int64] = perm
+
+		if !visible[perm.GithubID.Int64] {
+			report.add(DriftPermissions, perm.Slug.String,
+				fmt.Sprintf("stored %s, repository not visible on github", perm.Permission.String()))
+		}
+	}
+
+	for _, githubID := range order {
+		perm, ok := perms[githubID]
+		if !ok {
+			continue
+		}
+		if _, ok := stored[githubID]; !ok {
+			continue
+		}
+
+		storedPerm, ok := storedPermsByGithubID[githubID]
+		if !ok {
+			report.add(DriftPermissions, slugs[githubID],
+				fmt.Sprintf("github %s, no permission stored", perm.String()))
+			continue
+		}
+
+		if !perm.Equal(&storedPerm.Permission) {
+			report.add(DriftPermissions, slugs[githubID],
+				fmt.Sprintf("stored %s, github %s", storedPerm.Permission.String(), perm.String()))
+		}
+	}
+
+	return nil
+}
+
+// auditRepo maps a GitHub repository onto a Repository the way a sync
+// would, except that owners which are not stored yet are reported as drift
+// instead of being created.
+func (syncer *Syncer) auditRepo(rs *RepositoriesSyncer, ghRepo *GithubRepository, ctx *repoSyncContext, report *AuditReport) (*Repository, error) {
+	owner, err := rs.findRepoOwner(ghRepo, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if owner == nil {
+		report.add(DriftRepositories, ghRepo.Slug(), "owner not stored")
+		return nil, nil
+	}
+
+	repo := &Repository{}
+	err = repo.UpdateFromGithubRepository(ghRepo)
+	if err != nil {
+		return nil, err
+	}
+	repo.OwnerID = owner.ID()
+
+	return repo, nil
+}
@@ -0,0 +1,114 @@
+package accountsync
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+)
+
+type lookupCacheEntry struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+type LookupCacheStats struct {
+	Hits         int64
+	NegativeHits int64
+	Misses       int64
+	Expired      int64
+	Invalidated  int64
+	Len          int
+}
+
+// lookupCache is an LRU cache of database lookups whose entries expire.
+// A nil value records that the lookup found nothing, and is kept for the
+// (usually shorter) negative TTL.
+type lookupCache struct {
+	name        string
+	lru         *lru.Cache
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	hits         int64
+	negativeHits int64
+	misses       int64
+	expired      int64
+	invalidated  int64
+}
+
+func newLookupCache(name string, size int, ttl, negativeTTL time.Duration) (*lookupCache, error) {
+	c, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lookupCache{
+		name:        name,
+		lru:         c,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+	}, nil
+}
+
+// Get returns the cached value for key.  found is false if nothing usable
+// is cached; a nil value with found true is a cached miss.
+func (c *lookupCache) Get(key interface{}) (value interface{}, found bool) {
+	v, ok := c.lru.Get(key)
+	if !ok {
+		c.incr(&c.misses, "misses")
+		return nil, false
+	}
+
+	entry, ok := v.(*lookupCacheEntry)
+	if !ok || time.Now().After(entry.expiresAt) {
+		c.lru.Remove(key)
+		c.incr(&c.expired, "expired")
+		c.incr(&c.misses, "misses")
+		return nil, false
+	}
+
+	if entry.value == nil {
+		c.incr(&c.negativeHits, "negative_hits")
+	} else {
+		c.incr(&c.hits, "hits")
+	}
+
+	return entry.value, true
+}
+
+func (c *lookupCache) Add(key, value interface{}) {
+	ttl := c.ttl
+	if value == nil {
+		ttl = c.negativeTTL
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	c.lru.Add(key, &lookupCacheEntry{value: value, expiresAt: time.Now().Add(ttl)})
+}
+
+func (c *lookupCache) Invalidate(key interface{}) {
+	if c.lru.Contains(key) {
+		c.lru.Remove(key)
+		c.incr(&c.invalidated, "invalidated")
+	}
+}
+
+func (c *lookupCache) Stats() *LookupCacheStats {
+	return &LookupCacheStats{
+		Hits:         atomic.LoadInt64(&c.hits),
+		NegativeHits: atomic.LoadInt64(&c.negativeHits),
+		Misses:       atomic.LoadInt64(&c.misses),
+		Expired:      atomic.LoadInt64(&c.expired),
+		Invalidated:  atomic.LoadInt64(&c.invalidated),
+		Len:          c.lru.Len(),
+	}
+}
+
+func (c *lookupCache) incr(counter *int64, metric string) {
+	atomic.AddInt64(counter, 1)
+	incrMetric("cache."+c.name+"."+metric, 1)
+}
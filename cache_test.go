@@ -0,0 +1,60 @@
+package accountsync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLookupCache(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		ttl         time.Duration
+		negativeTTL time.Duration
+		value       interface{}
+		wait        time.Duration
+		found       bool
+	}{
+		{name: "hit", ttl: time.Hour, negativeTTL: time.Minute, value: "user", found: true},
+		{name: "negative hit", ttl: time.Hour, negativeTTL: time.Minute, value: nil, found: true},
+		{name: "expired", ttl: time.Millisecond, negativeTTL: time.Hour, value: "user", wait: 5 * time.Millisecond},
+		{name: "negative expired", ttl: time.Hour, negativeTTL: time.Millisecond, value: nil, wait: 5 * time.Millisecond},
+		{name: "not cached without ttl", ttl: 0, negativeTTL: time.Hour, value: "user"},
+		{name: "misses not cached without negative ttl", ttl: time.Hour, negativeTTL: 0, value: nil},
+	} {
+		c, err := newLookupCache("test", 10, tc.ttl, tc.negativeTTL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Add(1, tc.value)
+		time.Sleep(tc.wait)
+
+		value, found := c.Get(1)
+		if found != tc.found {
+			t.Errorf("%s: expected found to be %v", tc.name, tc.found)
+		}
+		if found && value != tc.value {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.value, value)
+		}
+	}
+}
+
+func TestLookupCacheInvalidate(t *testing.T) {
+	c, err := newLookupCache("test", 10, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Add(1, "user")
+	c.Invalidate(1)
+	c.Invalidate(2)
+
+	if _, found := c.Get(1); found {
+		t.Error("expected invalidated entry to be gone")
+	}
+
+	stats := c.Stats()
+	if stats.Invalidated != 1 || stats.Misses != 1 || stats.Hits != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
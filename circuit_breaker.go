@@ -0,0 +1,54 @@
+package accountsync
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreaker stops calls to a flaky dependency after a number of
+// consecutive failures, and lets a single call through again once the
+// cooldown has passed.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+func (cb *circuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.threshold <= 0 || cb.failures < cb.threshold {
+		return true
+	}
+
+	if time.Now().Sub(cb.openedAt) < cb.cooldown {
+		return false
+	}
+
+	// half open: the next failure opens it again for another cooldown
+	cb.failures = cb.threshold - 1
+	return true
+}
+
+func (cb *circuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures = 0
+}
+
+func (cb *circuitBreaker) Failure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	if cb.failures == cb.threshold {
+		cb.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,54 @@
+package accountsync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		threshold int
+		cooldown  time.Duration
+		// steps are "f" for a failure and "s" for a success
+		steps string
+		allow bool
+	}{
+		{name: "closed", threshold: 3, cooldown: time.Hour, steps: "", allow: true},
+		{name: "below threshold", threshold: 3, cooldown: time.Hour, steps: "ff", allow: true},
+		{name: "open at threshold", threshold: 3, cooldown: time.Hour, steps: "fff", allow: false},
+		{name: "success resets", threshold: 3, cooldown: time.Hour, steps: "ffsff", allow: true},
+		{name: "half open after cooldown", threshold: 3, cooldown: 0, steps: "fff", allow: true},
+		{name: "disabled", threshold: 0, cooldown: time.Hour, steps: "fffff", allow: true},
+	} {
+		cb := newCircuitBreaker(tc.threshold, tc.cooldown)
+		for _, step := range tc.steps {
+			if step == 'f' {
+				cb.Failure()
+			} else {
+				cb.Success()
+			}
+		}
+
+		if cb.Allow() != tc.allow {
+			t.Errorf("%s: expected Allow() to be %v", tc.name, tc.allow)
+		}
+	}
+}
+
+func TestCircuitBreakerReopensAfterHalfOpenFailure(t *testing.T) {
+	cb := newCircuitBreaker(2, time.Hour)
+	cb.Failure()
+	cb.Failure()
+
+	// pretend the cooldown passed
+	cb.openedAt = time.Now().Add(-2 * time.Hour)
+	if !cb.Allow() {
+		t.Fatal("expected a call to be let through after the cooldown")
+	}
+
+	cb.Failure()
+	if cb.Allow() {
+		t.Error("expected a failure when half open to open the breaker again")
+	}
+}
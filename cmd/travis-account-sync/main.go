@@ -1,29 +1,477 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/codegangsta/cli"
 	"github.com/travis-ci/account-sync"
+	"golang.org/x/net/context"
+)
+
+// Exit codes of the sync command, besides 0 for success and 1 for errors
+// setting up, such as an unreachable database.
+const (
+	exitConfigError     = 2
+	exitAllFailed       = 3
+	exitPartiallyFailed = 4
 )
 
 func main() {
 	app := cli.NewApp()
 	app.Usage = "Syncing accounts"
 	app.Version = accountsync.VersionString
-	app.Flags = accountsync.Flags
+	// Syncing without a command is deprecated, and only kept so that
+	// existing deployments keep working until they run "sync".
+	app.Flags = accountsync.SyncFlags
 	app.Action = func(c *cli.Context) {
-		cfg := accountsync.NewConfig(c)
-		err := cfg.Validate()
+		log.Printf("level=warn msg=\"running without a command is deprecated\" instead=sync")
+		syncAction(c)
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:   "sync",
+			Usage:  "sync the users given as arguments or via --github-usernames",
+			Flags:  accountsync.SyncFlags,
+			Action: syncAction,
+		},
+		{
+			Name:   "status",
+			Usage:  "show the sync state and last result of the user with the given login",
+			Flags:  accountsync.StatusFlags,
+			Action: statusAction,
+		},
+		{
+			Name:   "diff",
+			Usage:  "show what syncing the user with the given login would change",
+			Flags:  accountsync.DiffFlags,
+			Action: diffAction,
+		},
+		{
+			Name:   "audit",
+			Usage:  "report where the stored state of the user with the given login differs from GitHub",
+			Flags:  accountsync.DiffFlags,
+			Action: auditAction,
+		},
+		{
+			Name:  "users",
+			Usage: "list users",
+			Subcommands: []cli.Command{
+				{
+					Name:   "due",
+					Usage:  "list the logins of users due for a sync, least recently synced first",
+					Flags:  accountsync.UsersDueFlags,
+					Action: usersDueAction,
+				},
+			},
+		},
+		{
+			Name:  "serve-webhooks",
+			Usage: "receive GitHub webhooks and apply the changes they describe",
+			Flags: accountsync.WebhookFlags,
+			Action: func(c *cli.Context) {
+				cfg := accountsync.NewConfig(c)
+				err := cfg.Validate()
+				if err != nil {
+					log.Fatalf("err=%q", err.Error())
+				}
+				handler, err := accountsync.NewWebhookHandler(cfg)
+				if err != nil {
+					log.Fatalf("err=%q", err.Error())
+				}
+				http.Handle("/webhooks", handler)
+				log.Printf("msg=\"serving webhooks\" addr=%v", cfg.WebhookAddr)
+				log.Fatal(http.ListenAndServe(cfg.WebhookAddr, nil))
+			},
+		},
+		{
+			Name:  "rotate-tokens",
+			Usage: "re-encrypt all stored tokens with the primary encryption key",
+			Flags: accountsync.RotateTokensFlags,
+			Action: func(c *cli.Context) {
+				keyring, err := accountsync.NewKeyring(c.String("encryption-key"), c.StringSlice("old-encryption-keys"))
+				if err != nil {
+					log.Fatalf("err=%q", err.Error())
+				}
+				db, err := accountsync.NewDB(c.String("database-url"), 1, 0, 0)
+				if err != nil {
+					log.Fatalf("err=%q", err.Error())
+				}
+				err = accountsync.NewMigrator(db).CheckSchemaVersion()
+				if err != nil {
+					log.Fatalf("err=%q", err.Error())
+				}
+				rotator := accountsync.NewTokenRotator(db, keyring, c.Int("batch-size"))
+				stats, err := rotator.Rotate(int64(c.Int("start-id")))
+				if err != nil {
+					log.Fatalf("err=%q last_id=%v", err.Error(), stats.LastID)
+				}
+				if stats.Failed > 0 {
+					log.Fatalf("msg=\"some tokens could not be rotated\" failed=%v", stats.Failed)
+				}
+			},
+		},
+		{
+			Name:   "history",
+			Usage:  "show the most recent syncs of the user with the given login",
+			Flags:  accountsync.HistoryFlags,
+			Action: historyAction,
+		},
+		{
+			Name:  "migrate",
+			Usage: "manage the database schema",
+			Subcommands: []cli.Command{
+				{
+					Name:   "up",
+					Usage:  "apply all pending migrations",
+					Flags:  []cli.Flag{*accountsync.DatabaseURLFlag},
+					Action: migrateAction(func(mg *accountsync.Migrator) error { return mg.Up() }),
+				},
+				{
+					Name:   "down",
+					Usage:  "roll back the most recently applied migration",
+					Flags:  []cli.Flag{*accountsync.DatabaseURLFlag},
+					Action: migrateAction(func(mg *accountsync.Migrator) error { return mg.Down() }),
+				},
+				{
+					Name:   "status",
+					Usage:  "list migrations and whether they have been applied",
+					Flags:  []cli.Flag{*accountsync.DatabaseURLFlag},
+					Action: migrateAction(printMigrationStatus),
+				},
+			},
+		},
+		{
+			Name:  "version",
+			Usage: "print the version",
+			Action: func(c *cli.Context) {
+				fmt.Println(accountsync.VersionString)
+			},
+		},
+	}
+	app.Run(os.Args)
+}
+
+func syncAction(c *cli.Context) {
+	cfg := accountsync.NewConfig(c)
+	cfg.GithubUsernames = append(cfg.GithubUsernames, c.Args()...)
+	err := cfg.Validate()
+	if err != nil {
+		log.Printf("err=%q", err.Error())
+		os.Exit(exitConfigError)
+	}
+	syncer, err := accountsync.NewSyncer(cfg)
+	if err != nil {
+		log.Printf("err=%q", err.Error())
+		os.Exit(exitCode(nil, err))
+	}
+	ctx := contextWithShutdown()
+	result, err := syncer.Sync(ctx)
+	if err != nil {
+		log.Printf("err=%q", err.Error())
+		os.Exit(exitCode(nil, err))
+	}
+	if ctx.Err() != nil {
+		log.Printf("msg=\"shut down before syncing all users\"")
+	}
+
+	switch code := exitCode(result, nil); code {
+	case exitAllFailed:
+		log.Printf("msg=\"all users failed\" failed=%v", result.Failed)
+		os.Exit(code)
+	case exitPartiallyFailed:
+		log.Printf("msg=\"some users failed\" failed=%v completed=%v", result.Failed, result.Completed)
+		os.Exit(code)
+	}
+}
+
+// exitCode maps the outcome of a sync onto the exit status of the process.
+func exitCode(result *accountsync.SyncResult, err error) int {
+	if _, ok := err.(*accountsync.ConfigError); ok {
+		return exitConfigError
+	}
+	if err != nil {
+		return 1
+	}
+
+	switch {
+	case result.AllFailed():
+		return exitAllFailed
+	case result.PartiallyFailed():
+		return exitPartiallyFailed
+	}
+	return 0
+}
+
+func statusAction(c *cli.Context) {
+	login := requireLogin(c, "status")
+	db := openDB(c)
+
+	user, err := db.FindUserByLogin(login)
+	if err != nil {
+		log.Fatalf("err=%q", err.Error())
+	}
+	if user == nil {
+		log.Fatalf("msg=\"no user with that login\" login=%v", login)
+	}
+
+	token := "valid"
+	switch {
+	case !user.GithubOauthToken.Valid:
+		token = "missing"
+	case user.HasInvalidToken():
+		token = "invalid since " + formatTime(user.GithubOauthTokenInvalidAt)
+	}
+
+	fmt.Printf("login:                  %s\n", user.Login.String)
+	fmt.Printf("github_id:              %d\n", user.GithubID.Int64)
+	fmt.Printf("is_syncing:             %v\n", user.IsSyncing.Bool)
+	fmt.Printf("synced_at:              %s\n", formatTime(user.SyncedAt))
+	fmt.Printf("repositories_synced_at: %s\n", formatTime(user.RepositoriesSyncedAt))
+	fmt.Printf("token:                  %s\n", token)
+	fmt.Printf("token_expires_at:       %s\n", formatTime(user.GithubOauthTokenExpiresAt))
+	fmt.Println()
+
+	runs, err := accountsync.FindSyncRuns(db, login, 1)
+	if err != nil {
+		log.Fatalf("err=%q", err.Error())
+	}
+
+	if len(runs) == 0 {
+		fmt.Println("no syncs recorded")
+		return
+	}
+
+	fmt.Println("last sync:")
+	printSyncRun(runs[0])
+}
+
+func diffAction(c *cli.Context) {
+	login := requireLogin(c, "diff")
+	cfg := accountsync.NewConfig(c)
+	err := cfg.Validate()
+	if err != nil {
+		log.Fatalf("err=%q", err.Error())
+	}
+	syncer, err := accountsync.NewSyncer(cfg)
+	if err != nil {
+		log.Fatalf("err=%q", err.Error())
+	}
+
+	diff, err := syncer.Diff(contextWithShutdown(), login)
+	if err != nil {
+		log.Fatalf("err=%q", err.Error())
+	}
+
+	if diff.Empty() {
+		fmt.Printf("no changes for %s (%d repositories unchanged)\n", login, diff.ReposUnchanged)
+		return
+	}
+
+	for _, change := range diff.UserFields {
+		fmt.Printf("~ user %s: %q -> %q\n", change.Field, fmt.Sprint(change.Old), fmt.Sprint(change.New))
+	}
+	printDiffLines("+ email", diff.EmailsAdded)
+	printDiffLines("- email", diff.EmailsRemoved)
+	printDiffLines("+ membership", diff.MembershipsAdded)
+	printDiffLines("- membership", diff.MembershipsRemoved)
+	printDiffLines("+ repository", diff.ReposCreated)
+	printDiffLines("~ repository", diff.ReposUpdated)
+	fmt.Printf("%d repositories unchanged\n", diff.ReposUnchanged)
+}
+
+func auditAction(c *cli.Context) {
+	login := requireLogin(c, "audit")
+	cfg := accountsync.NewConfig(c)
+	err := cfg.Validate()
+	if err != nil {
+		log.Fatalf("err=%q", err.Error())
+	}
+	syncer, err := accountsync.NewSyncer(cfg)
+	if err != nil {
+		log.Fatalf("err=%q", err.Error())
+	}
+
+	report, err := syncer.Audit(contextWithShutdown(), login)
+	if err != nil {
+		log.Fatalf("err=%q", err.Error())
+	}
+
+	if len(report.Drifts) == 0 {
+		fmt.Printf("no drift for %s (%d repositories checked)\n", login, report.ReposChecked)
+		return
+	}
+
+	for _, category := range accountsync.DriftCategories {
+		drifts := report.InCategory(category)
+		fmt.Printf("%s: %d\n", category, len(drifts))
+		for _, drift := range drifts {
+			fmt.Printf("  %s: %s\n", drift.Subject, drift.Detail)
+		}
+	}
+	fmt.Printf("%d repositories checked\n", report.ReposChecked)
+}
+
+func printDiffLines(prefix string, values []string) {
+	for _, value := range values {
+		fmt.Printf("%s %s\n", prefix, value)
+	}
+}
+
+func usersDueAction(c *cli.Context) {
+	db := openDB(c)
+
+	users, err := db.FindUsersDue(time.Now().UTC().Add(-c.Duration("sync-interval")), c.Int("limit"))
+	if err != nil {
+		log.Fatalf("err=%q", err.Error())
+	}
+
+	for _, user := range users {
+		fmt.Println(user.Login.String)
+	}
+}
+
+// openDB connects to the database for commands which only read from it.
+func openDB(c *cli.Context) *accountsync.DB {
+	db, err := accountsync.NewDB(c.String("database-url"), 1, 0, 0)
+	if err != nil {
+		log.Fatalf("err=%q", err.Error())
+	}
+
+	err = accountsync.NewMigrator(db).CheckSchemaVersion()
+	if err != nil {
+		log.Fatalf("err=%q", err.Error())
+	}
+
+	return db
+}
+
+func requireLogin(c *cli.Context, command string) string {
+	login := c.Args().First()
+	if login == "" {
+		log.Fatalf("msg=\"missing login\" usage=\"%s <login>\"", command)
+	}
+	return login
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return t.Format("2006-01-02T15:04:05Z")
+}
+
+// contextWithShutdown returns a context which is cancelled on SIGINT or
+// SIGTERM, so that the sync can wind down cleanly.  A second signal exits
+// right away.
+func contextWithShutdown() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigs
+		log.Printf("msg=\"shutting down, finishing current work\" signal=%v", sig)
+		cancel()
+
+		sig = <-sigs
+		log.Printf("msg=\"exiting immediately\" signal=%v", sig)
+		os.Exit(1)
+	}()
+
+	return ctx
+}
+
+func historyAction(c *cli.Context) {
+	login := requireLogin(c, "history")
+	db := openDB(c)
+
+	runs, err := accountsync.FindSyncRuns(db, login, c.Int("limit"))
+	if err != nil {
+		log.Fatalf("err=%q", err.Error())
+	}
+
+	if len(runs) == 0 {
+		fmt.Printf("no syncs recorded for %s\n", login)
+		return
+	}
+
+	for _, run := range runs {
+		printSyncRun(run)
+	}
+}
+
+func printSyncRun(run *accountsync.SyncRun) {
+	duration := "-"
+	if run.FinishedAt != nil {
+		duration = fmt.Sprintf("%.1fs", run.FinishedAt.Sub(*run.StartedAt).Seconds())
+	}
+
+	fmt.Printf("%s  %-11s  %-12s  login=%s host=%s version=%s\n",
+		run.StartedAt.Format("2006-01-02T15:04:05Z"), run.Status.String, duration,
+		run.Login.String, run.Host.String, run.Version.String)
+
+	for _, stage := range run.Stages {
+		fmt.Printf("  %-14s %-11s %8.1fs  %s\n", stage.Name, stage.Status, stage.Seconds, stage.Error)
+	}
+
+	if len(run.Changes) > 0 {
+		names := []string{}
+		for name := range run.Changes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		changes := []string{}
+		for _, name := range names {
+			changes = append(changes, fmt.Sprintf("%s=%d", name, run.Changes[name]))
+		}
+		fmt.Printf("  changes: %s\n", strings.Join(changes, " "))
+	}
+
+	for _, msg := range run.Errors {
+		fmt.Printf("  error: %s\n", msg)
+	}
+
+	fmt.Println()
+}
+
+func migrateAction(f func(*accountsync.Migrator) error) func(*cli.Context) {
+	return func(c *cli.Context) {
+		db, err := accountsync.NewDB(c.String("database-url"), 1, 0, 0)
 		if err != nil {
 			log.Fatalf("err=%q", err.Error())
 		}
-		syncer, err := accountsync.NewSyncer(cfg)
+
+		err = f(accountsync.NewMigrator(db))
 		if err != nil {
 			log.Fatalf("err=%q", err.Error())
 		}
-		syncer.Sync()
 	}
-	app.Run(os.Args)
+}
+
+func printMigrationStatus(mg *accountsync.Migrator) error {
+	statuses, err := mg.Status()
+	if err != nil {
+		return err
+	}
+
+	for _, status := range statuses {
+		appliedAt := "pending"
+		if status.AppliedAt != nil {
+			appliedAt = status.AppliedAt.Format("2006-01-02T15:04:05Z")
+		}
+		fmt.Printf("%04d %-40s %s\n", status.Version, status.Name, appliedAt)
+	}
+
+	fmt.Printf("expected schema version: %v\n", accountsync.SchemaVersion())
+	return nil
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/travis-ci/account-sync"
+)
+
+func TestExitCode(t *testing.T) {
+	failed := map[string][]error{"a": {fmt.Errorf("failed")}}
+
+	for _, tc := range []struct {
+		name   string
+		result *accountsync.SyncResult
+		err    error
+		code   int
+	}{
+		{name: "nothing to do", result: &accountsync.SyncResult{}, code: 0},
+		{name: "all completed", result: &accountsync.SyncResult{Users: 2, Completed: 2}, code: 0},
+		{name: "skipped users are no failures", result: &accountsync.SyncResult{Users: 2, Locked: 1, SkippedInvalidTokens: 1}, code: 0},
+		{name: "all failed", result: &accountsync.SyncResult{Users: 1, Failed: 1, Errors: failed}, code: exitAllFailed},
+		{name: "some failed", result: &accountsync.SyncResult{Users: 2, Completed: 1, Failed: 1, Errors: failed}, code: exitPartiallyFailed},
+		{name: "config error", err: &accountsync.ConfigError{Err: fmt.Errorf("missing encryption key")}, code: exitConfigError},
+		{name: "setup error", err: fmt.Errorf("connection refused"), code: 1},
+	} {
+		code := exitCode(tc.result, tc.err)
+		if code != tc.code {
+			t.Errorf("%s: expected exit code %v, got %v", tc.name, tc.code, code)
+		}
+	}
+}
@@ -2,16 +2,28 @@ package accountsync
 
 import (
 	"fmt"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/codegangsta/cli"
 )
 
+const (
+	defaultGithubAPIURL = "https://api.github.com/"
+)
+
 var (
 	EncryptionKeyFlag = &cli.StringFlag{
 		Name:   "k, encryption-key",
 		Value:  "",
 		EnvVar: "TRAVIS_ACCOUNT_SYNC_ENCRYPTION_KEY",
 	}
+	OldEncryptionKeysFlag = &cli.StringSliceFlag{
+		Name:   "old-encryption-keys",
+		Value:  &cli.StringSlice{},
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_OLD_ENCRYPTION_KEYS",
+	}
 	DatabaseURLFlag = &cli.StringFlag{
 		Name:   "d, database-url",
 		Value:  "",
@@ -27,6 +39,16 @@ var (
 		Value:  1000,
 		EnvVar: "TRAVIS_ACCOUNT_SYNC_ORGANIZATIONS_REPOSITORIES_LIMIT",
 	}
+	LargeOrganizationsPagesPerSyncFlag = &cli.IntFlag{
+		Name:   "large-organizations-pages-per-sync",
+		Value:  5,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_LARGE_ORGANIZATIONS_PAGES_PER_SYNC",
+	}
+	RepositoriesFullSyncIntervalFlag = &cli.DurationFlag{
+		Name:   "repositories-full-sync-interval",
+		Value:  24 * time.Hour,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_REPOSITORIES_FULL_SYNC_INTERVAL",
+	}
 	RepositoriesStartPageFlag = &cli.IntFlag{
 		Name:   "repositories-start-page",
 		Value:  1,
@@ -42,45 +64,378 @@ var (
 		Value:  64,
 		EnvVar: "TRAVIS_ACCOUNT_SYNC_CACHE_SIZE",
 	}
+	SyncCacheTTLFlag = &cli.DurationFlag{
+		Name:   "sync-cache-ttl",
+		Value:  10 * time.Minute,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_CACHE_TTL",
+	}
+	SyncCacheNegativeTTLFlag = &cli.DurationFlag{
+		Name:   "sync-cache-negative-ttl",
+		Value:  time.Minute,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_CACHE_NEGATIVE_TTL",
+	}
+	UserTimeoutFlag = &cli.DurationFlag{
+		Name:   "user-timeout",
+		Value:  30 * time.Minute,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_USER_TIMEOUT",
+	}
+	UserInfoTimeoutFlag = &cli.DurationFlag{
+		Name:   "user-info-timeout",
+		Value:  2 * time.Minute,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_USER_INFO_TIMEOUT",
+	}
+	OrganizationsTimeoutFlag = &cli.DurationFlag{
+		Name:   "organizations-timeout",
+		Value:  5 * time.Minute,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_ORGANIZATIONS_TIMEOUT",
+	}
+	RepositoriesTimeoutFlag = &cli.DurationFlag{
+		Name:   "repositories-timeout",
+		Value:  20 * time.Minute,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_REPOSITORIES_TIMEOUT",
+	}
+	UserLockTimeoutFlag = &cli.DurationFlag{
+		Name:   "user-lock-timeout",
+		Value:  0,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_USER_LOCK_TIMEOUT",
+	}
+	StagesFlag = &cli.StringSliceFlag{
+		Name:   "stages",
+		Value:  &cli.StringSlice{},
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_STAGES",
+	}
+	GithubAppIDFlag = &cli.IntFlag{
+		Name:   "github-app-id",
+		Value:  0,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_GITHUB_APP_ID",
+	}
+	GithubAppPrivateKeyPathFlag = &cli.StringFlag{
+		Name:   "github-app-private-key-path",
+		Value:  "",
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_GITHUB_APP_PRIVATE_KEY_PATH",
+	}
+	GithubClientIDFlag = &cli.StringFlag{
+		Name:   "github-client-id",
+		Value:  "",
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_GITHUB_CLIENT_ID",
+	}
+	GithubClientSecretFlag = &cli.StringFlag{
+		Name:   "github-client-secret",
+		Value:  "",
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_GITHUB_CLIENT_SECRET",
+	}
+	GithubAPIURLFlag = &cli.StringFlag{
+		Name:   "github-api-url",
+		Value:  defaultGithubAPIURL,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_GITHUB_API_URL",
+	}
+	GithubUploadURLFlag = &cli.StringFlag{
+		Name:   "github-upload-url",
+		Value:  "https://uploads.github.com/",
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_GITHUB_UPLOAD_URL",
+	}
+	GithubWebURLFlag = &cli.StringFlag{
+		Name:   "github-web-url",
+		Value:  "https://github.com/",
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_GITHUB_WEB_URL",
+	}
+	DisableEducationFlag = &cli.BoolFlag{
+		Name:   "disable-education",
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_DISABLE_EDUCATION",
+	}
+	EducationURLFlag = &cli.StringFlag{
+		Name:   "education-url",
+		Value:  "https://education.github.com/api/user",
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_EDUCATION_URL",
+	}
+	EducationTimeoutFlag = &cli.DurationFlag{
+		Name:   "education-timeout",
+		Value:  5 * time.Second,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_EDUCATION_TIMEOUT",
+	}
+	EducationBreakerThresholdFlag = &cli.IntFlag{
+		Name:   "education-breaker-threshold",
+		Value:  5,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_EDUCATION_BREAKER_THRESHOLD",
+	}
+	EducationBreakerCooldownFlag = &cli.DurationFlag{
+		Name:   "education-breaker-cooldown",
+		Value:  5 * time.Minute,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_EDUCATION_BREAKER_COOLDOWN",
+	}
+	WebhookSecretFlag = &cli.StringFlag{
+		Name:   "webhook-secret",
+		Value:  "",
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_WEBHOOK_SECRET",
+	}
+	WebhookAddrFlag = &cli.StringFlag{
+		Name:   "webhook-addr",
+		Value:  ":8080",
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_WEBHOOK_ADDR",
+	}
 
-	Flags = []cli.Flag{
+	RotateTokensBatchSizeFlag = &cli.IntFlag{
+		Name:   "batch-size",
+		Value:  500,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_ROTATE_TOKENS_BATCH_SIZE",
+	}
+	RotateTokensStartIDFlag = &cli.IntFlag{
+		Name:   "start-id",
+		Value:  0,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_ROTATE_TOKENS_START_ID",
+	}
+
+	SyncIntervalFlag = &cli.DurationFlag{
+		Name:   "sync-interval",
+		Value:  24 * time.Hour,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_INTERVAL",
+	}
+	UsersDueLimitFlag = &cli.IntFlag{
+		Name:   "limit",
+		Value:  1000,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_USERS_DUE_LIMIT",
+	}
+	HistoryLimitFlag = &cli.IntFlag{
+		Name:   "limit",
+		Value:  20,
+		EnvVar: "TRAVIS_ACCOUNT_SYNC_HISTORY_LIMIT",
+	}
+
+	SyncFlags = []cli.Flag{
 		*EncryptionKeyFlag,
+		*OldEncryptionKeysFlag,
 		*DatabaseURLFlag,
 		*GithubUsernamesFlag,
 		*OrganizationsRepositoriesLimitFlag,
+		*LargeOrganizationsPagesPerSyncFlag,
+		*RepositoriesFullSyncIntervalFlag,
 		*RepositoriesStartPageFlag,
 		*SyncTypesFlag,
 		*SyncCacheSizeFlag,
+		*SyncCacheTTLFlag,
+		*SyncCacheNegativeTTLFlag,
+		*UserTimeoutFlag,
+		*UserInfoTimeoutFlag,
+		*OrganizationsTimeoutFlag,
+		*RepositoriesTimeoutFlag,
+		*UserLockTimeoutFlag,
+		*StagesFlag,
+		*GithubAppIDFlag,
+		*GithubAppPrivateKeyPathFlag,
+		*GithubClientIDFlag,
+		*GithubClientSecretFlag,
+		*GithubAPIURLFlag,
+		*GithubUploadURLFlag,
+		*GithubWebURLFlag,
+		*DisableEducationFlag,
+		*EducationURLFlag,
+		*EducationTimeoutFlag,
+		*EducationBreakerThresholdFlag,
+		*EducationBreakerCooldownFlag,
 	}
 
-	errPrivateSyncNotSupported = fmt.Errorf("private sync is not supported (yet)!")
+	// Flags are the flags of syncing, which used to be the only command.
+	// Deprecated: use SyncFlags.
+	Flags = SyncFlags
+
+	DiffFlags = []cli.Flag{
+		*EncryptionKeyFlag,
+		*OldEncryptionKeysFlag,
+		*DatabaseURLFlag,
+		*OrganizationsRepositoriesLimitFlag,
+		*SyncTypesFlag,
+		*SyncCacheSizeFlag,
+		*SyncCacheTTLFlag,
+		*SyncCacheNegativeTTLFlag,
+		*GithubAppIDFlag,
+		*GithubAppPrivateKeyPathFlag,
+		*GithubAPIURLFlag,
+		*GithubUploadURLFlag,
+		*GithubWebURLFlag,
+		*DisableEducationFlag,
+		*EducationURLFlag,
+		*EducationTimeoutFlag,
+	}
+
+	StatusFlags = []cli.Flag{
+		*DatabaseURLFlag,
+	}
+
+	UsersDueFlags = []cli.Flag{
+		*DatabaseURLFlag,
+		*SyncIntervalFlag,
+		*UsersDueLimitFlag,
+	}
+
+	RotateTokensFlags = []cli.Flag{
+		*EncryptionKeyFlag,
+		*OldEncryptionKeysFlag,
+		*DatabaseURLFlag,
+		*RotateTokensBatchSizeFlag,
+		*RotateTokensStartIDFlag,
+	}
+
+	HistoryFlags = []cli.Flag{
+		*DatabaseURLFlag,
+		*HistoryLimitFlag,
+	}
+
+	WebhookFlags = []cli.Flag{
+		*DatabaseURLFlag,
+		*SyncTypesFlag,
+		*SyncCacheSizeFlag,
+		*SyncCacheTTLFlag,
+		*SyncCacheNegativeTTLFlag,
+		*WebhookSecretFlag,
+		*WebhookAddrFlag,
+	}
+
+	errPrivateSyncNotSupported  = fmt.Errorf("private sync is not supported (yet)!")
+	errMissingGithubAppKey      = fmt.Errorf("a GitHub App ID requires a private key path")
+	errNegativeEducationTimeout = fmt.Errorf("the education timeout must not be negative")
+
+	// SyncStages are the stages of syncing a user, in the order they run.
+	SyncStages = []string{"user_info", "organizations", "repositories"}
 )
 
 type Config struct {
-	EncryptionKey                  string   `cfg:"encryption-key"` // TODO: do something with these tags
-	DatabaseURL                    string   `cfg:"database-url"`
-	GithubUsernames                []string `cfg:"github-usernames"`
-	OrganizationsRepositoriesLimit int      `cfg:"organizations-repositories-limit"`
-	RepositoriesStartPage          int      `cfg:"repositories-start-page"`
-	SyncTypes                      []string `cfg:"sync-types"`
-	SyncCacheSize                  int      `cfg:"sync-cache-size"`
+	EncryptionKey                  string        `cfg:"encryption-key"` // TODO: do something with these tags
+	OldEncryptionKeys              []string      `cfg:"old-encryption-keys"`
+	DatabaseURL                    string        `cfg:"database-url"`
+	GithubUsernames                []string      `cfg:"github-usernames"`
+	OrganizationsRepositoriesLimit int           `cfg:"organizations-repositories-limit"`
+	LargeOrganizationsPagesPerSync int           `cfg:"large-organizations-pages-per-sync"`
+	RepositoriesFullSyncInterval   time.Duration `cfg:"repositories-full-sync-interval"`
+	RepositoriesStartPage          int           `cfg:"repositories-start-page"`
+	SyncTypes                      []string      `cfg:"sync-types"`
+	SyncCacheSize                  int           `cfg:"sync-cache-size"`
+	SyncCacheTTL                   time.Duration `cfg:"sync-cache-ttl"`
+	SyncCacheNegativeTTL           time.Duration `cfg:"sync-cache-negative-ttl"`
+	UserTimeout                    time.Duration `cfg:"user-timeout"`
+	UserInfoTimeout                time.Duration `cfg:"user-info-timeout"`
+	OrganizationsTimeout           time.Duration `cfg:"organizations-timeout"`
+	RepositoriesTimeout            time.Duration `cfg:"repositories-timeout"`
+	UserLockTimeout                time.Duration `cfg:"user-lock-timeout"`
+	Stages                         []string      `cfg:"stages"`
+	GithubAppID                    int           `cfg:"github-app-id"`
+	GithubAppPrivateKeyPath        string        `cfg:"github-app-private-key-path"`
+	GithubClientID                 string        `cfg:"github-client-id"`
+	GithubClientSecret             string        `cfg:"github-client-secret"`
+	GithubAPIURL                   string        `cfg:"github-api-url"`
+	GithubUploadURL                string        `cfg:"github-upload-url"`
+	GithubWebURL                   string        `cfg:"github-web-url"`
+	DisableEducation               bool          `cfg:"disable-education"`
+	EducationURL                   string        `cfg:"education-url"`
+	EducationTimeout               time.Duration `cfg:"education-timeout"`
+	EducationBreakerThreshold      int           `cfg:"education-breaker-threshold"`
+	EducationBreakerCooldown       time.Duration `cfg:"education-breaker-cooldown"`
+	WebhookSecret                  string        `cfg:"webhook-secret"`
+	WebhookAddr                    string        `cfg:"webhook-addr"`
 }
 
 func NewConfig(c *cli.Context) *Config {
 	return &Config{
 		DatabaseURL:                    c.String("database-url"),
 		EncryptionKey:                  c.String("encryption-key"),
+		OldEncryptionKeys:              c.StringSlice("old-encryption-keys"),
 		GithubUsernames:                c.StringSlice("github-usernames"),
 		OrganizationsRepositoriesLimit: c.Int("organizations-repositories-limit"),
+		LargeOrganizationsPagesPerSync: c.Int("large-organizations-pages-per-sync"),
+		RepositoriesFullSyncInterval:   c.Duration("repositories-full-sync-interval"),
 		RepositoriesStartPage:          c.Int("repositories-start-page"),
 		SyncTypes:                      c.StringSlice("sync-types"),
 		SyncCacheSize:                  c.Int("sync-cache-size"),
+		SyncCacheTTL:                   c.Duration("sync-cache-ttl"),
+		SyncCacheNegativeTTL:           c.Duration("sync-cache-negative-ttl"),
+		UserTimeout:                    c.Duration("user-timeout"),
+		UserInfoTimeout:                c.Duration("user-info-timeout"),
+		OrganizationsTimeout:           c.Duration("organizations-timeout"),
+		RepositoriesTimeout:            c.Duration("repositories-timeout"),
+		UserLockTimeout:                c.Duration("user-lock-timeout"),
+		Stages:                         c.StringSlice("stages"),
+		GithubAppID:                    c.Int("github-app-id"),
+		GithubAppPrivateKeyPath:        c.String("github-app-private-key-path"),
+		GithubClientID:                 c.String("github-client-id"),
+		GithubClientSecret:             c.String("github-client-secret"),
+		GithubAPIURL:                   c.String("github-api-url"),
+		GithubUploadURL:                c.String("github-upload-url"),
+		GithubWebURL:                   c.String("github-web-url"),
+		DisableEducation:               c.Bool("disable-education"),
+		EducationURL:                   c.String("education-url"),
+		EducationTimeout:               c.Duration("education-timeout"),
+		EducationBreakerThreshold:      c.Int("education-breaker-threshold"),
+		EducationBreakerCooldown:       c.Duration("education-breaker-cooldown"),
+		WebhookSecret:                  c.String("webhook-secret"),
+		WebhookAddr:                    c.String("webhook-addr"),
+	}
+}
+
+// IsGithubEnterprise reports whether the API is not the one of github.com,
+// which means endpoints without an Enterprise equivalent are switched off.
+func (cfg *Config) IsGithubEnterprise() bool {
+	return strings.TrimSuffix(cfg.GithubAPIURL, "/") != strings.TrimSuffix(defaultGithubAPIURL, "/")
+}
+
+// StageEnabled reports whether the sync stage of the given name runs, which
+// all do unless some are selected.
+func (cfg *Config) StageEnabled(stage string) bool {
+	return len(cfg.Stages) == 0 || sliceContains(cfg.Stages, stage)
+}
+
+// AllStagesEnabled reports whether a sync covers every stage, so that a user
+// whose stages all complete counts as synced.
+func (cfg *Config) AllStagesEnabled() bool {
+	for _, stage := range SyncStages {
+		if !cfg.StageEnabled(stage) {
+			return false
+		}
 	}
+	return true
+}
+
+// ConfigError is an error caused by the configuration rather than by the
+// environment, such as an unreadable GitHub App key or a database at a
+// schema version the binary does not support.
+type ConfigError struct {
+	Err error
+}
+
+func (err *ConfigError) Error() string {
+	return err.Err.Error()
+}
+
+// EducationEnabled reports whether to look up if users are students, which
+// is only possible on github.com.
+func (cfg *Config) EducationEnabled() bool {
+	return !cfg.DisableEducation && cfg.EducationURL != "" && !cfg.IsGithubEnterprise()
 }
 
 func (cfg *Config) Validate() error {
 	if sliceContains(cfg.SyncTypes, "private") {
 		return errPrivateSyncNotSupported
 	}
+	if cfg.EducationTimeout < 0 {
+		return errNegativeEducationTimeout
+	}
+	if cfg.GithubAppID != 0 && cfg.GithubAppPrivateKeyPath == "" {
+		return errMissingGithubAppKey
+	}
+	for _, stage := range cfg.Stages {
+		if !sliceContains(SyncStages, stage) {
+			return fmt.Errorf("unknown sync stage %q, expected one of %s", stage, strings.Join(SyncStages, ", "))
+		}
+	}
+	for _, rawurl := range []string{cfg.GithubAPIURL, cfg.GithubUploadURL, cfg.GithubWebURL} {
+		if rawurl == "" {
+			continue
+		}
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid GitHub URL %q", rawurl)
+		}
+	}
 	return nil
 }
@@ -2,30 +2,31 @@ package accountsync
 
 import (
 	"database/sql"
+	"log"
+	"time"
 
-	"github.com/hashicorp/golang-lru"
 	"github.com/jmoiron/sqlx"
 )
 
 type DB struct {
 	*sqlx.DB
 
-	uc *lru.Cache
-	oc *lru.Cache
+	uc *lookupCache
+	oc *lookupCache
 }
 
-func NewDB(databaseURL string, syncCacheSize int) (*DB, error) {
+func NewDB(databaseURL string, syncCacheSize int, syncCacheTTL, syncCacheNegativeTTL time.Duration) (*DB, error) {
 	db, err := sqlx.Connect("postgres", databaseURL)
 	if err != nil {
 		return nil, err
 	}
 
-	uc, err := lru.New(syncCacheSize)
+	uc, err := newLookupCache("users", syncCacheSize, syncCacheTTL, syncCacheNegativeTTL)
 	if err != nil {
 		return nil, err
 	}
 
-	oc, err := lru.New(syncCacheSize)
+	oc, err := newLookupCache("organizations", syncCacheSize, syncCacheTTL, syncCacheNegativeTTL)
 	if err != nil {
 		return nil, err
 	}
@@ -38,51 +39,105 @@ func NewDB(databaseURL string, syncCacheSize int) (*DB, error) {
 }
 
 func (db *DB) FindUserByGithubID(ghUserID int) (*User, error) {
-	var (
-		user *User
-		ok   bool
-	)
-
 	u, found := db.uc.Get(ghUserID)
-	if user, ok = u.(*User); found && ok {
+	if found {
+		user, _ := u.(*User)
 		return user, nil
 	}
 
-	user = &User{}
+	user := &User{}
 	err := db.Get(user, `SELECT * FROM users WHERE github_id = $1`, ghUserID)
 	if err == sql.ErrNoRows {
 		user = nil
 		err = nil
 	}
 
+	if err != nil {
+		return nil, err
+	}
+
 	if user != nil {
 		db.uc.Add(ghUserID, user)
+	} else {
+		db.uc.Add(ghUserID, nil)
 	}
 
-	return user, err
+	return user, nil
 }
 
 func (db *DB) FindOrgByGithubID(ghOrgID int) (*Organization, error) {
-	var (
-		org *Organization
-		ok  bool
-	)
-
 	o, found := db.oc.Get(ghOrgID)
-	if org, ok = o.(*Organization); found && ok {
+	if found {
+		org, _ := o.(*Organization)
 		return org, nil
 	}
 
-	org = &Organization{}
+	org := &Organization{}
 	err := db.Get(org, `SELECT * FROM organizations WHERE github_id = $1`, ghOrgID)
 	if err == sql.ErrNoRows {
 		org = nil
 		err = nil
 	}
 
+	if err != nil {
+		return nil, err
+	}
+
 	if org != nil {
 		db.oc.Add(ghOrgID, org)
+	} else {
+		db.oc.Add(ghOrgID, nil)
+	}
+
+	return org, nil
+}
+
+// FindUserByLogin looks up a user without going through the cache, and
+// returns nil if there is none.
+func (db *DB) FindUserByLogin(login string) (*User, error) {
+	user := &User{}
+	err := db.Get(user, `SELECT * FROM users WHERE login = $1`, login)
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
 
-	return org, err
+// FindUsersDue returns the users with a usable token which have not been
+// synced since the given time, least recently synced first.
+func (db *DB) FindUsersDue(syncedBefore time.Time, limit int) ([]*User, error) {
+	users := []*User{}
+	err := db.Select(&users, `
+		SELECT *
+		FROM users
+		WHERE github_oauth_token IS NOT NULL
+		  AND (github_oauth_token_invalid_digest IS NULL OR github_oauth_token_invalid_digest <> md5(github_oauth_token))
+		  AND (synced_at IS NULL OR synced_at < $1)
+		ORDER BY synced_at ASC NULLS FIRST, id ASC
+		LIMIT $2
+	`, syncedBefore, limit)
+	return users, err
+}
+
+// InvalidateUser drops any cached lookup of the user with the given GitHub
+// ID, and must be called after the user has been created or updated.
+func (db *DB) InvalidateUser(ghUserID int) {
+	db.uc.Invalidate(ghUserID)
+}
+
+// InvalidateOrg drops any cached lookup of the organization with the given
+// GitHub ID, and must be called after the org has been created or updated.
+func (db *DB) InvalidateOrg(ghOrgID int) {
+	db.oc.Invalidate(ghOrgID)
+}
+
+func (db *DB) LogCacheStats() {
+	for _, c := range []*lookupCache{db.uc, db.oc} {
+		stats := c.Stats()
+		log.Printf("msg=\"cache stats\" cache=%v hits=%v negative_hits=%v misses=%v expired=%v invalidated=%v len=%v",
+			c.name, stats.Hits, stats.NegativeHits, stats.Misses, stats.Expired, stats.Invalidated, stats.Len)
+	}
 }
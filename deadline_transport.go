@@ -0,0 +1,93 @@
+package accountsync
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// deadlineTransport aborts requests still in flight when the deadline of
+// its context passes.  Cancellation without a deadline, as on shutdown, is
+// left to the syncers, which stop between pages.  The request is canceled
+// through the base transport and waited for, so nothing is left running
+// once RoundTrip returns; without a base that can cancel, requests are not
+// aborted.
+type deadlineTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+type requestCanceler interface {
+	CancelRequest(*http.Request)
+}
+
+func (dt *deadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	deadline, ok := dt.ctx.Deadline()
+	if !ok {
+		return dt.base.RoundTrip(req)
+	}
+
+	remaining := deadline.Sub(time.Now())
+	if remaining <= 0 {
+		return nil, errSyncTimedOut
+	}
+
+	canceler, ok := dt.base.(requestCanceler)
+	if !ok {
+		return dt.base.RoundTrip(req)
+	}
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		resp, err := dt.base.RoundTrip(req)
+		done <- result{resp: resp, err: err}
+	}()
+
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+
+	select {
+	case res := <-done:
+		return res.resp, res.err
+	case <-timer.C:
+		canceler.CancelRequest(req)
+		res := <-done
+		if res.resp != nil {
+			res.resp.Body.Close()
+		}
+		return nil, errSyncTimedOut
+	}
+}
+
+func (dt *deadlineTransport) CancelRequest(req *http.Request) {
+	if canceler, ok := dt.base.(requestCanceler); ok {
+		canceler.CancelRequest(req)
+	}
+}
+
+// withOptionalTimeout is context.WithTimeout, except that a timeout of zero
+// means none.
+func withOptionalTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// contextErr maps why runCtx is done to the error a syncer stopping early
+// returns, which is nil while it is not done.
+func contextErr(runCtx context.Context) error {
+	switch runCtx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return errSyncTimedOut
+	}
+	return errSyncInterrupted
+}
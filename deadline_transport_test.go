@@ -0,0 +1,50 @@
+package accountsync
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// blockingTransport blocks requests until they are canceled.
+type blockingTransport struct {
+	canceled chan struct{}
+	returned chan struct{}
+}
+
+func (bt *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	<-bt.canceled
+	close(bt.returned)
+	return nil, fmt.Errorf("net/http: request canceled")
+}
+
+func (bt *blockingTransport) CancelRequest(req *http.Request) {
+	close(bt.canceled)
+}
+
+func TestDeadlineTransportCancelsRequest(t *testing.T) {
+	base := &blockingTransport{canceled: make(chan struct{}), returned: make(chan struct{})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	dt := &deadlineTransport{ctx: ctx, base: base}
+	req, err := http.NewRequest("GET", "https://api.github.com/user", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = dt.RoundTrip(req)
+	if err != errSyncTimedOut {
+		t.Errorf("expected errSyncTimedOut, got %v", err)
+	}
+
+	select {
+	case <-base.returned:
+	default:
+		t.Error("expected the request to have returned along with RoundTrip")
+	}
+}
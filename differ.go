@@ -0,0 +1,320 @@
+package accountsync
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/net/context"
+)
+
+var (
+	errUnknownUser = fmt.Errorf("no user with that login")
+)
+
+// SyncDiff describes what syncing a user would change.
+type SyncDiff struct {
+	Login string
+
+	UserFields         []*FieldChange
+	EmailsAdded        []string
+	EmailsRemoved      []string
+	MembershipsAdded   []string
+	MembershipsRemoved []string
+	ReposCreated       []string
+	ReposUpdated       []string
+	ReposUnchanged     int
+}
+
+type FieldChange struct {
+	Field string
+	Old   interface{}
+	New   interface{}
+}
+
+func (diff *SyncDiff) addField(field string, old, new interface{}) {
+	if fmt.Sprintf("%v", old) == fmt.Sprintf("%v", new) {
+		return
+	}
+	diff.UserFields = append(diff.UserFields, &FieldChange{Field: field, Old: old, New: new})
+}
+
+// Empty reports whether a sync would change nothing.
+func (diff *SyncDiff) Empty() bool {
+	return len(diff.UserFields) == 0 && len(diff.EmailsAdded) == 0 && len(diff.EmailsRemoved) == 0 &&
+		len(diff.MembershipsAdded) == 0 && len(diff.MembershipsRemoved) == 0 &&
+		len(diff.ReposCreated) == 0 && len(diff.ReposUpdated) == 0
+}
+
+func newSyncDiff(login string) *SyncDiff {
+	return &SyncDiff{
+		Login:              login,
+		UserFields:         []*FieldChange{},
+		EmailsAdded:        []string{},
+		EmailsRemoved:      []string{},
+		MembershipsAdded:   []string{},
+		MembershipsRemoved: []string{},
+		ReposCreated:       []string{},
+		ReposUpdated:       []string{},
+	}
+}
+
+// readOnlyClient looks up the user with the given login and returns a
+// client with their token, which is not refreshed when expired, as that
+// would write to the database.
+func (syncer *Syncer) readOnlyClient(runCtx context.Context, login string) (*User, *github.Client, http.RoundTripper, error) {
+	user, err := syncer.db.FindUserByLogin(login)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if user == nil {
+		return nil, nil, nil, errUnknownUser
+	}
+
+	err = user.Hydrate()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	keyring, err := NewKeyring(syncer.cfg.EncryptionKey, syncer.cfg.OldEncryptionKeys)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	ts, err := newUserTokenSource(syncer.db, syncer.cfg, keyring, user)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ts.refresher = nil
+
+	transport := &deadlineTransport{ctx: runCtx, base: ts.Transport()}
+	client, err := newGithubClientWithTransport(syncer.cfg, transport)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return user, client, transport, nil
+}
+
+// Diff reads the user with the given login from GitHub the way a sync does,
+// and compares it with what is stored, without writing anything.
+func (syncer *Syncer) Diff(runCtx context.Context, login string) (*SyncDiff, error) {
+	user, client, transport, err := syncer.readOnlyClient(runCtx, login)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := newSyncDiff(login)
+	err = syncer.diffUserInfo(runCtx, user, client, transport, diff)
+	if err != nil {
+		return nil, err
+	}
+
+	orgs, err := syncer.diffOrganizations(runCtx, user, client, diff)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := []*Owner{&Owner{Type: "user", User: user}}
+	for _, org := range orgs {
+		owners = append(owners, &Owner{Type: "organization", Organization: org})
+	}
+
+	for _, owner := range owners {
+		err = syncer.diffRepositories(runCtx, owner, user, client, diff)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return diff, nil
+}
+
+func (syncer *Syncer) diffUserInfo(runCtx context.Context, user *User, client *github.Client, transport http.RoundTripper, diff *SyncDiff) error {
+	uis := NewUserInfoSyncer(syncer.db, syncer.cfg)
+	ctx := &userInfoSyncContext{
+		runCtx:         runCtx,
+		user:           user,
+		client:         client,
+		transport:      transport,
+		allEmails:      []github.UserEmail{},
+		verifiedEmails: []string{},
+		currentEmails:  []string{},
+	}
+
+	ghUser, resp, err := client.Users.Get(user.Login.String)
+	if err != nil {
+		return err
+	}
+
+	err = checkGithubUser(ghUser)
+	if err != nil {
+		return err
+	}
+	ctx.ghUser = ghUser
+
+	if resp != nil && resp.Response != nil {
+		header, ok := resp.Header[http.CanonicalHeaderKey("X-OAuth-Scopes")]
+		scopes := parseGithubScopes(strings.Join(header, ","))
+		if ok && user.ScopesDiffer(scopes) {
+			diff.addField("github_scopes", user.GithubScopes, scopes)
+		}
+	}
+
+	email, err := uis.getUserEmail(ctx)
+	if err != nil {
+		return err
+	}
+
+	isEdu := user.Education.Bool
+	if edu := uis.getIsEducation(ctx); edu != nil {
+		isEdu = *edu
+	}
+
+	diff.addField("name", user.Name.String, strPtrOrEmpty(ghUser.Name))
+	diff.addField("login", user.Login.String, *ghUser.Login)
+	diff.addField("gravatar_id", user.GravatarID.String, strPtrOrEmpty(ghUser.GravatarID))
+	diff.addField("email", user.Email.String, email)
+	diff.addField("education", user.Education.Bool, isEdu)
+
+	diff.EmailsRemoved, diff.EmailsAdded = uis.emailChanges(ctx)
+	return nil
+}
+
+// diffOrganizations records membership changes, and returns the orgs the
+// user would be a member of after a sync.
+func (syncer *Syncer) diffOrganizations(runCtx context.Context, user *User, client *github.Client, diff *SyncDiff) ([]*Organization, error) {
+	osync := NewOrganizationSyncer(syncer.db, syncer.cfg)
+	ctx := &orgSyncContext{
+		runCtx:  runCtx,
+		user:    user,
+		client:  client,
+		curOrgs: map[int64]*Organization{},
+		ghOrgs:  map[int64]*github.Organization{},
+	}
+
+	err := user.HydrateOrganizations(syncer.db)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, org := range user.Organizations {
+		ctx.curOrgs[org.GithubID.Int64] = org
+	}
+
+	ghOrgs, err := osync.getGithubOrgs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	orgs := []*Organization{}
+	for _, ghOrg := range ghOrgs {
+		githubID := int64(*ghOrg.ID)
+		ctx.ghOrgs[githubID] = ghOrg
+
+		if org, ok := ctx.curOrgs[githubID]; ok {
+			orgs = append(orgs, org)
+			continue
+		}
+
+		org, err := syncer.db.FindOrgByGithubID(*ghOrg.ID)
+		if err != nil {
+			return nil, err
+		}
+		if org == nil {
+			org = &Organization{}
+			org.UpdateFromGithubOrganization(ghOrg, syncer.cfg.OrganizationsRepositoriesLimit)
+		}
+
+		orgs = append(orgs, org)
+		diff.MembershipsAdded = append(diff.MembershipsAdded, org.Login.String)
+	}
+
+	for githubID, org := range ctx.curOrgs {
+		if _, ok := ctx.ghOrgs[githubID]; !ok && user.CanListPrivateOrgs() {
+			diff.MembershipsRemoved = append(diff.MembershipsRemoved, org.Login.String)
+		}
+	}
+
+	return orgs, nil
+}
+
+// diffRepositories reads all repositories of the owner, as a full sync
+// would, and records the ones which would be created or updated.
+func (syncer *Syncer) diffRepositories(runCtx context.Context, owner *Owner, user *User, client *github.Client, diff *SyncDiff) error {
+	ors := NewOwnerRepositoriesSyncer(syncer.db, syncer.cfg, syncer.app)
+	ownerClient, _, err := ors.clientFor(runCtx, owner, client)
+	if err != nil {
+		return err
+	}
+
+	rs := NewRepositoriesSyncer(syncer.db, syncer.cfg)
+	ctx := &repoSyncContext{
+		runCtx:    runCtx,
+		owner:     owner,
+		user:      user,
+		client:    ownerClient,
+		startedAt: time.Now().UTC(),
+		full:      true,
+		readOnly:  true,
+	}
+
+	for _, syncType := range syncer.cfg.SyncTypes {
+		opts := &github.RepositoryListOptions{
+			Type:      syncType,
+			Sort:      "full_name",
+			Direction: "asc",
+			ListOptions: github.ListOptions{
+				PerPage: 100,
+				Page:    1,
+			},
+		}
+
+		for {
+			err = contextErr(runCtx)
+			if err != nil {
+				return err
+			}
+
+			repos, response, err := rs.listRepositories(opts, ctx)
+			if err != nil {
+				return err
+			}
+
+			pageRepos := []*Repository{}
+			for i := range repos {
+				repo, err := rs.prepareRepo(&repos[i], ctx)
+				if err != nil {
+					return err
+				}
+				if repo != nil {
+					pageRepos = append(pageRepos, repo)
+				}
+			}
+
+			changed, unchanged, _, err := rs.partitionUnchangedRepos(pageRepos, ctx)
+			if err != nil {
+				return err
+			}
+
+			for _, repo := range changed {
+				slug := repo.OwnerName.String + "/" + repo.Name.String
+				if repo.ID.Valid {
+					diff.ReposUpdated = append(diff.ReposUpdated, slug)
+				} else {
+					diff.ReposCreated = append(diff.ReposCreated, slug)
+				}
+			}
+			diff.ReposUnchanged += len(unchanged)
+
+			if response == nil || response.NextPage == 0 {
+				break
+			}
+			opts.ListOptions.Page = response.NextPage
+		}
+	}
+
+	return nil
+}
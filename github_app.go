@@ -0,0 +1,271 @@
+package accountsync
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	githubAppMediaType = "application/vnd.github.machine-man-preview+json"
+
+	// installation tokens are refreshed this long before they expire
+	installationTokenExpiryMargin = 5 * time.Minute
+
+	// installations looked up for orgs, or found missing, are remembered
+	// this long
+	installationLookupTTL = time.Hour
+)
+
+var (
+	errInvalidGithubAppKey = fmt.Errorf("the GitHub App private key is not a PEM encoded RSA key")
+)
+
+// GithubApp authenticates as a GitHub App and hands out installation
+// tokens, which it caches until shortly before they expire.
+type GithubApp struct {
+	id      int
+	key     *rsa.PrivateKey
+	baseURL string
+	client  *http.Client
+
+	mu            sync.Mutex
+	tokens        map[int]*oauth2.Token
+	installations map[string]*installationLookup
+}
+
+type installationLookup struct {
+	id        int
+	fetchedAt time.Time
+}
+
+func NewGithubApp(id int, privateKeyPEM []byte, baseURL string) (*GithubApp, error) {
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return nil, errInvalidGithubAppKey
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, pkcs8Err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if pkcs8Err != nil {
+			return nil, errInvalidGithubAppKey
+		}
+
+		var ok bool
+		key, ok = parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errInvalidGithubAppKey
+		}
+	}
+
+	return &GithubApp{
+		id:      id,
+		key:     key,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 30 * time.Second},
+		tokens:  map[int]*oauth2.Token{},
+
+		installations: map[string]*installationLookup{},
+	}, nil
+}
+
+// NewGithubAppFromFile reads the app's private key from a PEM file.
+func NewGithubAppFromFile(id int, privateKeyPath, baseURL string) (*GithubApp, error) {
+	privateKeyPEM, err := ioutil.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return NewGithubApp(id, privateKeyPEM, baseURL)
+}
+
+// InstallationTokenSource returns a token source for the installation with
+// the given ID.
+func (app *GithubApp) InstallationTokenSource(installationID int) oauth2.TokenSource {
+	return &installationTokenSource{app: app, installationID: installationID}
+}
+
+// OrgInstallationID returns the ID of the app's installation on the org
+// with the given login, or 0 if the app is not installed there.
+func (app *GithubApp) OrgInstallationID(login string) (int, error) {
+	app.mu.Lock()
+	lookup, ok := app.installations[login]
+	app.mu.Unlock()
+
+	if ok && time.Now().Sub(lookup.fetchedAt) < installationLookupTTL {
+		return lookup.id, nil
+	}
+
+	id, err := app.fetchOrgInstallationID(login)
+	if err != nil {
+		return 0, err
+	}
+
+	app.mu.Lock()
+	app.installations[login] = &installationLookup{id: id, fetchedAt: time.Now()}
+	app.mu.Unlock()
+
+	return id, nil
+}
+
+func (app *GithubApp) fetchOrgInstallationID(login string) (int, error) {
+	jwt, err := app.jwt()
+	if err != nil {
+		return 0, err
+	}
+
+	reqURL := fmt.Sprintf("%s/orgs/%s/installation", app.baseURL, url.QueryEscape(login))
+	req, err := http.NewRequest("GET", reqURL, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Accept", githubAppMediaType)
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("User-Agent", githubUserAgent())
+
+	resp, err := app.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("looking up installation of org %v failed with status %v", login, resp.Status)
+	}
+
+	body := struct {
+		ID int `json:"id"`
+	}{}
+
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return 0, err
+	}
+
+	return body.ID, nil
+}
+
+func (app *GithubApp) installationToken(installationID int) (*oauth2.Token, error) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	token, ok := app.tokens[installationID]
+	if ok && time.Now().Add(installationTokenExpiryMargin).Before(token.Expiry) {
+		return token, nil
+	}
+
+	log.Printf("msg=\"creating installation token\" installation_id=%v", installationID)
+	token, err := app.createInstallationToken(installationID)
+	if err != nil {
+		return nil, err
+	}
+
+	app.tokens[installationID] = token
+	return token, nil
+}
+
+func (app *GithubApp) createInstallationToken(installationID int) (*oauth2.Token, error) {
+	jwt, err := app.jwt()
+	if err != nil {
+		return nil, err
+	}
+
+	reqURL := fmt.Sprintf("%s/app/installations/%v/access_tokens", app.baseURL, installationID)
+	req, err := http.NewRequest("POST", reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", githubAppMediaType)
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("User-Agent", githubUserAgent())
+
+	resp, err := app.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("creating installation token failed with status %v", resp.Status)
+	}
+
+	body := struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{}
+
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauth2.Token{
+		AccessToken: body.Token,
+		TokenType:   "token",
+		Expiry:      body.ExpiresAt,
+	}, nil
+}
+
+// jwt returns a JSON Web Token identifying the app, signed with its private
+// key and valid for the few minutes it takes to exchange it.
+func (app *GithubApp) jwt() (string, error) {
+	now := time.Now().UTC()
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]interface{}{
+		// allow for clock drift between us and GitHub
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": app.id,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := jwtEncode(header) + "." + jwtEncode(claims)
+	hashed := sha256.Sum256([]byte(signingInput))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, app.key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + jwtEncode(signature), nil
+}
+
+func jwtEncode(b []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(b), "=")
+}
+
+type installationTokenSource struct {
+	app            *GithubApp
+	installationID int
+}
+
+func (its *installationTokenSource) Token() (*oauth2.Token, error) {
+	return its.app.installationToken(its.installationID)
+}
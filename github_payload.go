@@ -0,0 +1,63 @@
+package accountsync
+
+import (
+	"fmt"
+
+	"github.com/google/go-github/github"
+)
+
+// GitHub leaves out fields it has no value for, such as the name of a user
+// who never set one, and the go-github types represent every field as a
+// pointer.  The checks below cover the fields which a payload is useless
+// without, whereas all others are read with the *PtrOr* helpers.
+
+type incompletePayloadError struct {
+	Kind  string
+	Field string
+}
+
+func (err *incompletePayloadError) Error() string {
+	return fmt.Sprintf("incomplete GitHub %s payload: missing %s", err.Kind, err.Field)
+}
+
+func checkGithubUser(ghUser *github.User) error {
+	if ghUser == nil {
+		return &incompletePayloadError{Kind: "user", Field: "user"}
+	}
+	if ghUser.ID == nil {
+		return &incompletePayloadError{Kind: "user", Field: "id"}
+	}
+	if ghUser.Login == nil {
+		return &incompletePayloadError{Kind: "user", Field: "login"}
+	}
+	return nil
+}
+
+func checkGithubOrg(ghOrg *github.Organization) error {
+	if ghOrg == nil {
+		return &incompletePayloadError{Kind: "organization", Field: "organization"}
+	}
+	if ghOrg.ID == nil {
+		return &incompletePayloadError{Kind: "organization", Field: "id"}
+	}
+	if ghOrg.Login == nil {
+		return &incompletePayloadError{Kind: "organization", Field: "login"}
+	}
+	return nil
+}
+
+func checkGithubRepo(ghRepo *GithubRepository) error {
+	if ghRepo == nil {
+		return &incompletePayloadError{Kind: "repository", Field: "repository"}
+	}
+	if ghRepo.ID == nil {
+		return &incompletePayloadError{Kind: "repository", Field: "id"}
+	}
+	if ghRepo.Owner == nil {
+		return &incompletePayloadError{Kind: "repository", Field: "owner"}
+	}
+	if ghRepo.Owner.ID == nil {
+		return &incompletePayloadError{Kind: "repository", Field: "owner.id"}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package accountsync
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/net/context"
+)
+
+func TestCheckGithubPayloads(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		check func() error
+		field string
+	}{
+		{"user", func() error { return checkGithubUser(&github.User{ID: intPtr(1), Login: strPtr("a")}) }, ""},
+		{"nil user", func() error { return checkGithubUser(nil) }, "user"},
+		{"user without id", func() error { return checkGithubUser(&github.User{Login: strPtr("a")}) }, "id"},
+		{"user without login", func() error { return checkGithubUser(&github.User{ID: intPtr(1)}) }, "login"},
+		{"org", func() error { return checkGithubOrg(&github.Organization{ID: intPtr(1), Login: strPtr("a")}) }, ""},
+		{"nil org", func() error { return checkGithubOrg(nil) }, "organization"},
+		{"org without login", func() error { return checkGithubOrg(&github.Organization{ID: intPtr(1)}) }, "login"},
+		{"repo", func() error { return checkGithubRepo(decodeGithubRepo(t, `{"id":1,"owner":{"id":2}}`)) }, ""},
+		{"nil repo", func() error { return checkGithubRepo(nil) }, "repository"},
+		{"repo without owner", func() error { return checkGithubRepo(decodeGithubRepo(t, `{"id":1}`)) }, "owner"},
+		{"repo without owner id", func() error { return checkGithubRepo(decodeGithubRepo(t, `{"id":1,"owner":{}}`)) }, "owner.id"},
+	} {
+		err := tc.check()
+		if tc.field == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+			}
+			continue
+		}
+
+		payloadErr, ok := err.(*incompletePayloadError)
+		if !ok || payloadErr.Field != tc.field {
+			t.Errorf("%s: expected missing %v, got %v", tc.name, tc.field, err)
+		}
+	}
+}
+
+func decodeGithubRepo(t *testing.T, payload string) *GithubRepository {
+	ghRepo := &GithubRepository{}
+	err := json.Unmarshal([]byte(payload), ghRepo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ghRepo
+}
+
+func TestUpdateFromSparseGithubRepository(t *testing.T) {
+	ghRepo := decodeGithubRepo(t, `{"id":1,"name":"repo","owner":{"id":2,"login":"owner"}}`)
+
+	repo := &Repository{}
+	err := repo.UpdateFromGithubRepository(ghRepo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		field    string
+		actual   interface{}
+		expected interface{}
+	}{
+		{"github_id", repo.GithubID, sql.NullInt64{Int64: 1, Valid: true}},
+		{"name", repo.Name, sql.NullString{String: "repo", Valid: true}},
+		{"owner_type", repo.OwnerType, sql.NullString{String: "", Valid: true}},
+		{"description", repo.Description, sql.NullString{String: "", Valid: true}},
+		// a repository of unknown visibility is taken to be private
+		{"private", repo.Private, sql.NullBool{Bool: true, Valid: true}},
+		{"fork", repo.Fork, sql.NullBool{Bool: false, Valid: true}},
+		{"parent_github_id", repo.ParentGithubID, sql.NullInt64{}},
+		{"slug", ghRepo.Slug(), "owner/repo"},
+	} {
+		if tc.actual != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.field, tc.expected, tc.actual)
+		}
+	}
+
+	if repo.PushedAt != nil {
+		t.Errorf("expected no pushed_at, got %v", repo.PushedAt)
+	}
+}
+
+func TestUpdateFromSparseGithubOrganization(t *testing.T) {
+	ghOrg := &github.Organization{}
+	err := json.Unmarshal([]byte(`{"id":1,"login":"org"}`), ghOrg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	org := &Organization{}
+	org.UpdateFromGithubOrganization(ghOrg, 100)
+
+	if org.Name != (sql.NullString{String: "", Valid: true}) {
+		t.Errorf("expected an empty name, got %v", org.Name)
+	}
+	if org.PublicRepos.Valid {
+		t.Errorf("expected no public repos count, got %v", org.PublicRepos)
+	}
+	if org.Large != (sql.NullBool{Bool: false, Valid: true}) {
+		t.Errorf("expected an org of unknown size not to be large, got %v", org.Large)
+	}
+}
+
+func TestUserInfoChangedWithSparseGithubUser(t *testing.T) {
+	user := &User{
+		Name:       sql.NullString{String: "", Valid: true},
+		Login:      sql.NullString{String: "user", Valid: true},
+		GravatarID: sql.NullString{String: "", Valid: true},
+		Email:      sql.NullString{String: "user@example.com", Valid: true},
+		Education:  sql.NullBool{Bool: false, Valid: true},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		payload string
+		changed bool
+	}{
+		{"no name and gravatar", `{"id":1,"login":"user"}`, false},
+		{"name set", `{"id":1,"login":"user","name":"User"}`, true},
+		{"gravatar set", `{"id":1,"login":"user","gravatar_id":"abc"}`, true},
+	} {
+		ghUser := &github.User{}
+		err := json.Unmarshal([]byte(tc.payload), ghUser)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		uis := &UserInfoSyncer{}
+		if uis.userInfoChanged(user, ghUser, "user@example.com", false) != tc.changed {
+			t.Errorf("%s: expected changed to be %v", tc.name, tc.changed)
+		}
+	}
+}
+
+func TestChooseGithubEmail(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		profile  *string
+		emails   string
+		stored   string
+		email    string
+		verified int
+	}{
+		{"no emails", nil, `[]`, "", "", 0},
+		{"stored", nil, `[]`, "stored@example.com", "stored@example.com", 0},
+		{"profile", strPtr("public@example.com"), `[{"email":"primary@example.com","primary":true}]`, "", "public@example.com", 0},
+		{"primary", nil, `[{"email":"first@example.com"},{"email":"primary@example.com","primary":true}]`, "", "primary@example.com", 0},
+		{"verified", nil, `[{"email":"first@example.com"},{"email":"verified@example.com","verified":true}]`, "", "verified@example.com", 1},
+		{"first", nil, `[{"email":"first@example.com"},{"email":"second@example.com"}]`, "", "first@example.com", 0},
+		{"missing addresses skipped", nil, `[{"primary":true,"verified":true},{"email":""},{"email":"other@example.com"}]`, "", "other@example.com", 0},
+		{"missing flags", nil, `[{"email":"other@example.com","primary":null}]`, "stored@example.com", "stored@example.com", 0},
+	} {
+		emails := []github.UserEmail{}
+		err := json.Unmarshal([]byte(tc.emails), &emails)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		email, verified := chooseGithubEmail(tc.profile, emails, tc.stored)
+		if email != tc.email || len(verified) != tc.verified {
+			t.Errorf("%s: expected %q with %v verified, got %q with %v",
+				tc.name, tc.email, tc.verified, email, verified)
+		}
+	}
+}
+
+func TestRunStageRecoversPanics(t *testing.T) {
+	syncer := &Syncer{cfg: &Config{
+		GithubAPIURL:    "https://api.github.com/",
+		GithubUploadURL: "https://uploads.github.com/",
+	}}
+
+	stage := syncStage{
+		name: "user_info",
+		sync: func(stageCtx context.Context, client *github.Client, transport http.RoundTripper) error {
+			// what mapping a sparse payload without the nil checks does
+			ghUser := &github.User{}
+			_ = *ghUser.Name
+			return nil
+		},
+	}
+
+	err := syncer.runStage(context.Background(), stage, "some-login", http.DefaultTransport)
+	if _, ok := err.(*StagePanicError); !ok {
+		t.Fatalf("expected a StagePanicError, got %v", err)
+	}
+
+	syncErrs := syncErrors(err, "some-login", stage.name)
+	if len(syncErrs) != 1 {
+		t.Fatalf("expected one error, got %v", syncErrs)
+	}
+	if syncErrs[0].Login != "some-login" || syncErrs[0].Stage != "user_info" || syncErrs[0].Err != err {
+		t.Errorf("expected the panic as an error of the user's stage, got %+v", syncErrs[0])
+	}
+}
+
+func intPtr(i int) *int       { return &i }
+func strPtr(s string) *string { return &s }
@@ -1,5 +1,7 @@
 package accountsync
 
+import "time"
+
 func sliceContains(sl []string, s string) bool {
 	for _, candidate := range sl {
 		if candidate == s {
@@ -16,3 +18,24 @@ func strPtrOrEmpty(ptr *string) string {
 	}
 	return *ptr
 }
+
+func intPtrOrZero(ptr *int) int {
+	if ptr == nil {
+		return 0
+	}
+	return *ptr
+}
+
+func boolPtrOrFalse(ptr *bool) bool {
+	if ptr == nil {
+		return false
+	}
+	return *ptr
+}
+
+func timePtrsEqual(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(*b)
+}
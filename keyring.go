@@ -0,0 +1,82 @@
+package accountsync
+
+import (
+	"fmt"
+
+	"github.com/travis-ci/encrypted-column"
+)
+
+var (
+	errMissingEncryptionKey = fmt.Errorf("missing encryption key")
+	errNoDecryptionKey      = fmt.Errorf("none of the encryption keys decrypts the value")
+)
+
+// Keyring encrypts with its primary key and decrypts with the primary key or
+// any of the old keys, so that keys can be rotated without downtime.
+type Keyring struct {
+	cols []*encryptedcolumn.EncryptedColumn
+}
+
+func NewKeyring(primaryKey string, oldKeys []string) (*Keyring, error) {
+	if primaryKey == "" {
+		return nil, errMissingEncryptionKey
+	}
+
+	kr := &Keyring{cols: []*encryptedcolumn.EncryptedColumn{}}
+
+	for _, key := range append([]string{primaryKey}, oldKeys...) {
+		if key == "" {
+			continue
+		}
+
+		col, err := encryptedcolumn.NewEncryptedColumn(key, true)
+		if err != nil {
+			return nil, err
+		}
+		kr.cols = append(kr.cols, col)
+	}
+
+	return kr, nil
+}
+
+func (kr *Keyring) Load(s string) (string, error) {
+	value, _, err := kr.LoadWithKeyIndex(s)
+	return value, err
+}
+
+// LoadWithKeyIndex decrypts s and also returns the index of the key that
+// decrypted it, with 0 being the primary key.
+func (kr *Keyring) LoadWithKeyIndex(s string) (string, int, error) {
+	var lastErr error = errNoDecryptionKey
+
+	for i, col := range kr.cols {
+		value, err := col.Load(s)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		// decrypting with the wrong key does not reliably fail, but it
+		// does not produce a token either
+		if !isPrintableASCII(value) {
+			continue
+		}
+
+		return value, i, nil
+	}
+
+	return "", -1, lastErr
+}
+
+func (kr *Keyring) Dump(s string) (string, error) {
+	return kr.cols[0].Dump(s)
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package accountsync
+
+import "testing"
+
+const (
+	testEncryptionKey    = "a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1"
+	testOldEncryptionKey = "0f1e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0"
+)
+
+func TestKeyringLoadWithKeyIndex(t *testing.T) {
+	old, err := NewKeyring(testOldEncryptionKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := old.Dump("abc123token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		primary string
+		oldKeys []string
+		index   int
+		fails   bool
+	}{
+		{name: "primary key", primary: testOldEncryptionKey, index: 0},
+		{name: "old key", primary: testEncryptionKey, oldKeys: []string{testOldEncryptionKey}, index: 1},
+		{name: "empty old keys skipped", primary: testEncryptionKey, oldKeys: []string{"", testOldEncryptionKey}, index: 1},
+		{name: "wrong key", primary: testEncryptionKey, fails: true},
+	} {
+		kr, err := NewKeyring(tc.primary, tc.oldKeys)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		value, index, err := kr.LoadWithKeyIndex(encrypted)
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", tc.name, value)
+			}
+			if index != -1 {
+				t.Errorf("%s: expected index -1, got %v", tc.name, index)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if value != "abc123token" || index != tc.index {
+			t.Errorf("%s: expected %q with key %v, got %q with key %v",
+				tc.name, "abc123token", tc.index, value, index)
+		}
+	}
+}
+
+func TestNewKeyringWithoutKey(t *testing.T) {
+	_, err := NewKeyring("", []string{testOldEncryptionKey})
+	if err != errMissingEncryptionKey {
+		t.Errorf("expected %v, got %v", errMissingEncryptionKey, err)
+	}
+}
+
+func TestIsPrintableASCII(t *testing.T) {
+	for _, tc := range []struct {
+		s         string
+		printable bool
+	}{
+		{"", true},
+		{"abc123token", true},
+		{"with space~", true},
+		{"tab\there", false},
+		{"nul\x00", false},
+		{"del\x7f", false},
+		{"ümlaut", false},
+	} {
+		if isPrintableASCII(tc.s) != tc.printable {
+			t.Errorf("%q: expected %v", tc.s, tc.printable)
+		}
+	}
+}
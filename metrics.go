@@ -0,0 +1,40 @@
+package accountsync
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// metrics are published via expvar, so they show up under /debug/vars for
+// any process serving http.DefaultServeMux.  Processes that serve nothing,
+// such as sync, log them when done with metricsLogfmt.
+var metrics = expvar.NewMap("account_sync")
+
+func incrMetric(name string, delta int) {
+	metrics.Add(name, int64(delta))
+}
+
+// metricsLogfmt formats the metrics as logfmt pairs, sorted by name.
+func metricsLogfmt() string {
+	pairs := []string{}
+	metrics.Do(func(kv expvar.KeyValue) {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", kv.Key, kv.Value.String()))
+	})
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// countChange increments a metric of changes made by a sync, and counts
+// them towards the run of the user being synced, if any.
+func countChange(runCtx context.Context, name string, delta int) {
+	incrMetric(name, delta)
+
+	if run := syncRunFromContext(runCtx); run != nil {
+		run.countChange(name, delta)
+	}
+}
@@ -0,0 +1,18 @@
+package accountsync
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetricsLogfmt(t *testing.T) {
+	incrMetric("test.b", 2)
+	incrMetric("test.a", 1)
+
+	line := metricsLogfmt()
+	a := strings.Index(line, "test.a=")
+	b := strings.Index(line, "test.b=")
+	if a < 0 || b < 0 || a > b {
+		t.Errorf("expected the metrics sorted by name, got %q", line)
+	}
+}
@@ -0,0 +1,84 @@
+CREATE TABLE IF NOT EXISTS users (
+  id serial PRIMARY KEY,
+  name character varying,
+  login character varying,
+  email character varying,
+  created_at timestamp without time zone NOT NULL,
+  updated_at timestamp without time zone NOT NULL,
+  is_admin boolean DEFAULT false,
+  github_id integer,
+  github_oauth_token character varying,
+  gravatar_id character varying,
+  locale character varying,
+  is_syncing boolean,
+  synced_at timestamp without time zone,
+  github_scopes text,
+  education boolean
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS index_users_on_github_id ON users (github_id);
+CREATE INDEX IF NOT EXISTS index_users_on_login ON users (login);
+
+CREATE TABLE IF NOT EXISTS organizations (
+  id serial PRIMARY KEY,
+  name character varying,
+  login character varying,
+  github_id integer,
+  created_at timestamp without time zone NOT NULL,
+  updated_at timestamp without time zone NOT NULL,
+  avatar_url character varying,
+  location character varying,
+  email character varying,
+  company character varying,
+  homepage character varying
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS index_organizations_on_github_id ON organizations (github_id);
+
+CREATE TABLE IF NOT EXISTS memberships (
+  id serial PRIMARY KEY,
+  organization_id integer,
+  user_id integer
+);
+
+CREATE INDEX IF NOT EXISTS index_memberships_on_user_id ON memberships (user_id);
+
+CREATE TABLE IF NOT EXISTS emails (
+  id serial PRIMARY KEY,
+  user_id integer,
+  email character varying,
+  created_at timestamp without time zone NOT NULL,
+  updated_at timestamp without time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS index_emails_on_user_id ON emails (user_id);
+
+CREATE TABLE IF NOT EXISTS repositories (
+  id serial PRIMARY KEY,
+  name character varying,
+  url character varying,
+  created_at timestamp without time zone NOT NULL,
+  updated_at timestamp without time zone NOT NULL,
+  last_build_id integer,
+  last_build_number character varying,
+  last_build_started_at timestamp without time zone,
+  last_build_finished_at timestamp without time zone,
+  owner_name character varying,
+  owner_email text,
+  active boolean,
+  description text,
+  last_build_duration integer,
+  owner_id integer,
+  owner_type character varying,
+  private boolean DEFAULT false,
+  last_build_state character varying,
+  github_id integer,
+  default_branch character varying,
+  github_language character varying,
+  settings json,
+  next_build_number integer,
+  last_sync timestamp without time zone
+);
+
+CREATE INDEX IF NOT EXISTS index_repositories_on_github_id ON repositories (github_id);
+CREATE INDEX IF NOT EXISTS index_repositories_on_owner_id ON repositories (owner_id);
@@ -0,0 +1,13 @@
+UPDATE repositories SET url = homepage;
+
+ALTER TABLE repositories
+  DROP COLUMN archived,
+  DROP COLUMN disabled,
+  DROP COLUMN fork,
+  DROP COLUMN homepage,
+  DROP COLUMN parent_github_id,
+  DROP COLUMN parent_slug,
+  DROP COLUMN pushed_at,
+  DROP COLUMN source_github_id,
+  DROP COLUMN source_slug,
+  DROP COLUMN topics;
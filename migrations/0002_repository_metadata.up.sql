@@ -0,0 +1,14 @@
+ALTER TABLE repositories
+  ADD COLUMN archived boolean NOT NULL DEFAULT false,
+  ADD COLUMN disabled boolean NOT NULL DEFAULT false,
+  ADD COLUMN fork boolean NOT NULL DEFAULT false,
+  ADD COLUMN homepage character varying,
+  ADD COLUMN parent_github_id integer,
+  ADD COLUMN parent_slug character varying,
+  ADD COLUMN pushed_at timestamp without time zone,
+  ADD COLUMN source_github_id integer,
+  ADD COLUMN source_slug character varying,
+  ADD COLUMN topics text;
+
+-- url used to hold the homepage, which now has a column of its own
+UPDATE repositories SET homepage = url;
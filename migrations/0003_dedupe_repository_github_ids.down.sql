@@ -0,0 +1,5 @@
+UPDATE repositories SET github_id = duplicates.github_id
+FROM account_sync_repository_github_id_duplicates duplicates
+WHERE repositories.id = duplicates.repository_id;
+
+DROP TABLE account_sync_repository_github_id_duplicates;
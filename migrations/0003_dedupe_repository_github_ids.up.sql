@@ -0,0 +1,21 @@
+-- repositories are upserted by github_id, which needs a unique index.  The
+-- most recently updated of the rows sharing a github_id keeps it, the others
+-- lose it, and are kept here so that the migration can be rolled back.
+CREATE TABLE account_sync_repository_github_id_duplicates (
+  repository_id integer PRIMARY KEY,
+  github_id integer NOT NULL
+);
+
+INSERT INTO account_sync_repository_github_id_duplicates (repository_id, github_id)
+SELECT id, github_id FROM (
+  SELECT id, github_id, row_number() OVER (
+    PARTITION BY github_id ORDER BY updated_at DESC NULLS LAST, id DESC
+  ) AS rank
+  FROM repositories
+  WHERE github_id IS NOT NULL
+) ranked
+WHERE rank > 1;
+
+UPDATE repositories SET github_id = NULL
+FROM account_sync_repository_github_id_duplicates duplicates
+WHERE repositories.id = duplicates.repository_id;
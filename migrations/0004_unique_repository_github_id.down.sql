@@ -0,0 +1,5 @@
+-- account-sync: no transaction
+DROP INDEX CONCURRENTLY IF EXISTS index_repositories_on_github_id_plain;
+CREATE INDEX CONCURRENTLY index_repositories_on_github_id_plain ON repositories (github_id);
+DROP INDEX CONCURRENTLY IF EXISTS index_repositories_on_github_id;
+ALTER INDEX index_repositories_on_github_id_plain RENAME TO index_repositories_on_github_id;
@@ -0,0 +1,8 @@
+-- account-sync: no transaction
+-- the index is built next to the existing one and swapped in, so that
+-- repositories are neither locked for writes nor left without an index.  A
+-- build that failed leaves an invalid index behind, which is dropped first.
+DROP INDEX CONCURRENTLY IF EXISTS index_repositories_on_github_id_unique;
+CREATE UNIQUE INDEX CONCURRENTLY index_repositories_on_github_id_unique ON repositories (github_id);
+DROP INDEX CONCURRENTLY IF EXISTS index_repositories_on_github_id;
+ALTER INDEX index_repositories_on_github_id_unique RENAME TO index_repositories_on_github_id;
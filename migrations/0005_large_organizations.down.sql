@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS index_memberships_on_organization_id;
+
+ALTER TABLE organizations
+  DROP COLUMN public_repos,
+  DROP COLUMN large,
+  DROP COLUMN repositories_sync_page,
+  DROP COLUMN repositories_sync_reason;
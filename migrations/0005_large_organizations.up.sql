@@ -0,0 +1,7 @@
+ALTER TABLE organizations
+  ADD COLUMN public_repos integer,
+  ADD COLUMN large boolean NOT NULL DEFAULT false,
+  ADD COLUMN repositories_sync_page integer,
+  ADD COLUMN repositories_sync_reason character varying;
+
+CREATE INDEX IF NOT EXISTS index_memberships_on_organization_id ON memberships (organization_id);
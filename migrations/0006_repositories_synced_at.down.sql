@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS index_repositories_on_last_sync;
+
+ALTER TABLE users DROP COLUMN repositories_synced_at;
+ALTER TABLE organizations DROP COLUMN repositories_synced_at;
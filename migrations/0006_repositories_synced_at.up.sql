@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN repositories_synced_at timestamp without time zone;
+ALTER TABLE organizations ADD COLUMN repositories_synced_at timestamp without time zone;
+
+CREATE INDEX IF NOT EXISTS index_repositories_on_last_sync ON repositories (last_sync);
@@ -0,0 +1,2 @@
+ALTER TABLE repositories DROP COLUMN deleted_at;
+ALTER TABLE organizations DROP COLUMN github_installation_id;
@@ -0,0 +1,2 @@
+ALTER TABLE repositories ADD COLUMN deleted_at timestamp without time zone;
+ALTER TABLE organizations ADD COLUMN github_installation_id integer;
@@ -0,0 +1,4 @@
+ALTER TABLE users
+  DROP COLUMN github_oauth_token_expires_at,
+  DROP COLUMN github_refresh_token,
+  DROP COLUMN github_refresh_token_expires_at;
@@ -0,0 +1,4 @@
+ALTER TABLE users
+  ADD COLUMN github_oauth_token_expires_at timestamp without time zone,
+  ADD COLUMN github_refresh_token character varying,
+  ADD COLUMN github_refresh_token_expires_at timestamp without time zone;
@@ -0,0 +1,3 @@
+ALTER TABLE users
+  DROP COLUMN github_oauth_token_invalid,
+  DROP COLUMN github_oauth_token_invalid_at;
@@ -0,0 +1,3 @@
+ALTER TABLE users
+  ADD COLUMN github_oauth_token_invalid character varying,
+  ADD COLUMN github_oauth_token_invalid_at timestamp without time zone;
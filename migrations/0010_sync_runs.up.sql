@@ -0,0 +1,15 @@
+CREATE TABLE sync_runs (
+  id serial PRIMARY KEY,
+  user_id integer NOT NULL,
+  login character varying,
+  started_at timestamp without time zone NOT NULL,
+  finished_at timestamp without time zone,
+  status character varying NOT NULL,
+  stages text,
+  changes text,
+  errors text,
+  version character varying,
+  host character varying
+);
+
+CREATE INDEX index_sync_runs_on_user_id_and_started_at ON sync_runs (user_id, started_at);
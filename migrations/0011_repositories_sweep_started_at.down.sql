@@ -0,0 +1 @@
+ALTER TABLE organizations DROP COLUMN repositories_sweep_started_at;
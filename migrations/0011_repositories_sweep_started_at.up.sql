@@ -0,0 +1 @@
+ALTER TABLE organizations ADD COLUMN repositories_sweep_started_at timestamp without time zone;
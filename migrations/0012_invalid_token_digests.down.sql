@@ -0,0 +1,9 @@
+ALTER TABLE users
+  ADD COLUMN github_oauth_token_invalid character varying;
+
+UPDATE users
+SET github_oauth_token_invalid = github_oauth_token
+WHERE github_oauth_token_invalid_digest = md5(github_oauth_token);
+
+ALTER TABLE users
+  DROP COLUMN github_oauth_token_invalid_digest;
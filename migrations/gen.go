@@ -0,0 +1,53 @@
+//go:build ignore
+// +build ignore
+
+// gen.go bundles the SQL migrations in this directory into
+// migrations_data.go so that they ship inside the binary.  It is run via
+// `go generate` from the package root.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+)
+
+func main() {
+	filenames, err := filepath.Glob(filepath.Join("migrations", "*.sql"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sort.Strings(filenames)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintln(buf, "// generated by `go generate` from migrations/*.sql; DO NOT EDIT")
+	fmt.Fprintln(buf)
+	fmt.Fprintln(buf, "package accountsync")
+	fmt.Fprintln(buf)
+	fmt.Fprintln(buf, "var migrationFiles = map[string]string{")
+
+	for _, filename := range filenames {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(buf, "\t%q: %q,\n", filepath.Base(filename), string(content))
+	}
+
+	fmt.Fprintln(buf, "}")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = ioutil.WriteFile("migrations_data.go", src, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
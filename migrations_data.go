@@ -0,0 +1,29 @@
+// generated by `go generate` from migrations/*.sql; DO NOT EDIT
+
+package accountsync
+
+var migrationFiles = map[string]string{
+	"0001_initial_schema.up.sql":                  "CREATE TABLE IF NOT EXISTS users (\n  id serial PRIMARY KEY,\n  name character varying,\n  login character varying,\n  email character varying,\n  created_at timestamp without time zone NOT NULL,\n  updated_at timestamp without time zone NOT NULL,\n  is_admin boolean DEFAULT false,\n  github_id integer,\n  github_oauth_token character varying,\n  gravatar_id character varying,\n  locale character varying,\n  is_syncing boolean,\n  synced_at timestamp without time zone,\n  github_scopes text,\n  education boolean\n);\n\nCREATE UNIQUE INDEX IF NOT EXISTS index_users_on_github_id ON users (github_id);\nCREATE INDEX IF NOT EXISTS index_users_on_login ON users (login);\n\nCREATE TABLE IF NOT EXISTS organizations (\n  id serial PRIMARY KEY,\n  name character varying,\n  login character varying,\n  github_id integer,\n  created_at timestamp without time zone NOT NULL,\n  updated_at timestamp without time zone NOT NULL,\n  avatar_url character varying,\n  location character varying,\n  email character varying,\n  company character varying,\n  homepage character varying\n);\n\nCREATE UNIQUE INDEX IF NOT EXISTS index_organizations_on_github_id ON organizations (github_id);\n\nCREATE TABLE IF NOT EXISTS memberships (\n  id serial PRIMARY KEY,\n  organization_id integer,\n  user_id integer\n);\n\nCREATE INDEX IF NOT EXISTS index_memberships_on_user_id ON memberships (user_id);\n\nCREATE TABLE IF NOT EXISTS emails (\n  id serial PRIMARY KEY,\n  user_id integer,\n  email character varying,\n  created_at timestamp without time zone NOT NULL,\n  updated_at timestamp without time zone NOT NULL\n);\n\nCREATE INDEX IF NOT EXISTS index_emails_on_user_id ON emails (user_id);\n\nCREATE TABLE IF NOT EXISTS repositories (\n  id serial PRIMARY KEY,\n  name character varying,\n  url character varying,\n  created_at timestamp without time zone NOT NULL,\n  updated_at timestamp without time zone NOT NULL,\n  last_build_id integer,\n  last_build_number character varying,\n  last_build_started_at timestamp without time zone,\n  last_build_finished_at timestamp without time zone,\n  owner_name character varying,\n  owner_email text,\n  active boolean,\n  description text,\n  last_build_duration integer,\n  owner_id integer,\n  owner_type character varying,\n  private boolean DEFAULT false,\n  last_build_state character varying,\n  github_id integer,\n  default_branch character varying,\n  github_language character varying,\n  settings json,\n  next_build_number integer,\n  last_sync timestamp without time zone\n);\n\nCREATE INDEX IF NOT EXISTS index_repositories_on_github_id ON repositories (github_id);\nCREATE INDEX IF NOT EXISTS index_repositories_on_owner_id ON repositories (owner_id);\n",
+	"0002_repository_metadata.down.sql":           "UPDATE repositories SET url = homepage;\n\nALTER TABLE repositories\n  DROP COLUMN archived,\n  DROP COLUMN disabled,\n  DROP COLUMN fork,\n  DROP COLUMN homepage,\n  DROP COLUMN parent_github_id,\n  DROP COLUMN parent_slug,\n  DROP COLUMN pushed_at,\n  DROP COLUMN source_github_id,\n  DROP COLUMN source_slug,\n  DROP COLUMN topics;\n",
+	"0002_repository_metadata.up.sql":             "ALTER TABLE repositories\n  ADD COLUMN archived boolean NOT NULL DEFAULT false,\n  ADD COLUMN disabled boolean NOT NULL DEFAULT false,\n  ADD COLUMN fork boolean NOT NULL DEFAULT false,\n  ADD COLUMN homepage character varying,\n  ADD COLUMN parent_github_id integer,\n  ADD COLUMN parent_slug character varying,\n  ADD COLUMN pushed_at timestamp without time zone,\n  ADD COLUMN source_github_id integer,\n  ADD COLUMN source_slug character varying,\n  ADD COLUMN topics text;\n\n-- url used to hold the homepage, which now has a column of its own\nUPDATE repositories SET homepage = url;\n",
+	"0003_dedupe_repository_github_ids.down.sql":  "UPDATE repositories SET github_id = duplicates.github_id\nFROM account_sync_repository_github_id_duplicates duplicates\nWHERE repositories.id = duplicates.repository_id;\n\nDROP TABLE account_sync_repository_github_id_duplicates;\n",
+	"0003_dedupe_repository_github_ids.up.sql":    "-- repositories are upserted by github_id, which needs a unique index.  The\n-- most recently updated of the rows sharing a github_id keeps it, the others\n-- lose it, and are kept here so that the migration can be rolled back.\nCREATE TABLE account_sync_repository_github_id_duplicates (\n  repository_id integer PRIMARY KEY,\n  github_id integer NOT NULL\n);\n\nINSERT INTO account_sync_repository_github_id_duplicates (repository_id, github_id)\nSELECT id, github_id FROM (\n  SELECT id, github_id, row_number() OVER (\n    PARTITION BY github_id ORDER BY updated_at DESC NULLS LAST, id DESC\n  ) AS rank\n  FROM repositories\n  WHERE github_id IS NOT NULL\n) ranked\nWHERE rank > 1;\n\nUPDATE repositories SET github_id = NULL\nFROM account_sync_repository_github_id_duplicates duplicates\nWHERE repositories.id = duplicates.repository_id;\n",
+	"0004_unique_repository_github_id.down.sql":   "-- account-sync: no transaction\nDROP INDEX CONCURRENTLY IF EXISTS index_repositories_on_github_id_plain;\nCREATE INDEX CONCURRENTLY index_repositories_on_github_id_plain ON repositories (github_id);\nDROP INDEX CONCURRENTLY IF EXISTS index_repositories_on_github_id;\nALTER INDEX index_repositories_on_github_id_plain RENAME TO index_repositories_on_github_id;\n",
+	"0004_unique_repository_github_id.up.sql":     "-- account-sync: no transaction\n-- the index is built next to the existing one and swapped in, so that\n-- repositories are neither locked for writes nor left without an index.  A\n-- build that failed leaves an invalid index behind, which is dropped first.\nDROP INDEX CONCURRENTLY IF EXISTS index_repositories_on_github_id_unique;\nCREATE UNIQUE INDEX CONCURRENTLY index_repositories_on_github_id_unique ON repositories (github_id);\nDROP INDEX CONCURRENTLY IF EXISTS index_repositories_on_github_id;\nALTER INDEX index_repositories_on_github_id_unique RENAME TO index_repositories_on_github_id;\n",
+	"0005_large_organizations.down.sql":           "DROP INDEX IF EXISTS index_memberships_on_organization_id;\n\nALTER TABLE organizations\n  DROP COLUMN public_repos,\n  DROP COLUMN large,\n  DROP COLUMN repositories_sync_page,\n  DROP COLUMN repositories_sync_reason;\n",
+	"0005_large_organizations.up.sql":             "ALTER TABLE organizations\n  ADD COLUMN public_repos integer,\n  ADD COLUMN large boolean NOT NULL DEFAULT false,\n  ADD COLUMN repositories_sync_page integer,\n  ADD COLUMN repositories_sync_reason character varying;\n\nCREATE INDEX IF NOT EXISTS index_memberships_on_organization_id ON memberships (organization_id);\n",
+	"0006_repositories_synced_at.down.sql":        "DROP INDEX IF EXISTS index_repositories_on_last_sync;\n\nALTER TABLE users DROP COLUMN repositories_synced_at;\nALTER TABLE organizations DROP COLUMN repositories_synced_at;\n",
+	"0006_repositories_synced_at.up.sql":          "ALTER TABLE users ADD COLUMN repositories_synced_at timestamp without time zone;\nALTER TABLE organizations ADD COLUMN repositories_synced_at timestamp without time zone;\n\nCREATE INDEX IF NOT EXISTS index_repositories_on_last_sync ON repositories (last_sync);\n",
+	"0007_webhooks.down.sql":                      "ALTER TABLE repositories DROP COLUMN deleted_at;\nALTER TABLE organizations DROP COLUMN github_installation_id;\n",
+	"0007_webhooks.up.sql":                        "ALTER TABLE repositories ADD COLUMN deleted_at timestamp without time zone;\nALTER TABLE organizations ADD COLUMN github_installation_id integer;\n",
+	"0008_refresh_tokens.down.sql":                "ALTER TABLE users\n  DROP COLUMN github_oauth_token_expires_at,\n  DROP COLUMN github_refresh_token,\n  DROP COLUMN github_refresh_token_expires_at;\n",
+	"0008_refresh_tokens.up.sql":                  "ALTER TABLE users\n  ADD COLUMN github_oauth_token_expires_at timestamp without time zone,\n  ADD COLUMN github_refresh_token character varying,\n  ADD COLUMN github_refresh_token_expires_at timestamp without time zone;\n",
+	"0009_invalid_tokens.down.sql":                "ALTER TABLE users\n  DROP COLUMN github_oauth_token_invalid,\n  DROP COLUMN github_oauth_token_invalid_at;\n",
+	"0009_invalid_tokens.up.sql":                  "ALTER TABLE users\n  ADD COLUMN github_oauth_token_invalid character varying,\n  ADD COLUMN github_oauth_token_invalid_at timestamp without time zone;\n",
+	"0010_sync_runs.down.sql":                     "DROP TABLE sync_runs;\n",
+	"0010_sync_runs.up.sql":                       "CREATE TABLE sync_runs (\n  id serial PRIMARY KEY,\n  user_id integer NOT NULL,\n  login character varying,\n  started_at timestamp without time zone NOT NULL,\n  finished_at timestamp without time zone,\n  status character varying NOT NULL,\n  stages text,\n  changes text,\n  errors text,\n  version character varying,\n  host character varying\n);\n\nCREATE INDEX index_sync_runs_on_user_id_and_started_at ON sync_runs (user_id, started_at);\n",
+	"0011_repositories_sweep_started_at.down.sql": "ALTER TABLE organizations DROP COLUMN repositories_sweep_started_at;\n",
+	"0011_repositories_sweep_started_at.up.sql":   "ALTER TABLE organizations ADD COLUMN repositories_sweep_started_at timestamp without time zone;\n",
+	"0012_invalid_token_digests.down.sql":         "ALTER TABLE users\n  ADD COLUMN github_oauth_token_invalid character varying;\n\nUPDATE users\nSET github_oauth_token_invalid = github_oauth_token\nWHERE github_oauth_token_invalid_digest = md5(github_oauth_token);\n\nALTER TABLE users\n  DROP COLUMN github_oauth_token_invalid_digest;\n",
+	"0012_invalid_token_digests.up.sql":           "ALTER TABLE users\n  ADD COLUMN github_oauth_token_invalid_digest character varying;\n\nUPDATE users\nSET github_oauth_token_invalid_digest = md5(github_oauth_token_invalid)\nWHERE github_oauth_token_invalid IS NOT NULL;\n\nALTER TABLE users\n  DROP COLUMN github_oauth_token_invalid;\n",
+}
@@ -0,0 +1,351 @@
+package accountsync
+
+//go:generate go run migrations/gen.go
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	migrationFilenameRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+	errNoMigrationsApplied = fmt.Errorf("no migrations have been applied")
+	// the baseline migration takes over the tables Travis already has, so
+	// rolling it back would drop every account
+	errBaselineRollback = fmt.Errorf("the baseline schema cannot be rolled back")
+)
+
+// noTransactionMarker starts migrations that cannot run in a transaction,
+// such as ones building indexes concurrently.  Their statements are run one
+// by one, so a migration that failed halfway must be safe to run again.
+const noTransactionMarker = "-- account-sync: no transaction"
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	*Migration
+
+	AppliedAt *time.Time
+}
+
+type SchemaVersionError struct {
+	Current  int
+	Expected int
+}
+
+func (err *SchemaVersionError) Error() string {
+	return fmt.Sprintf("msg=\"incompatible schema version, run `migrate up`\" "+
+		"schema_version=%v expected_schema_version=%v", err.Current, err.Expected)
+}
+
+type migrationsByVersion []*Migration
+
+func (m migrationsByVersion) Len() int           { return len(m) }
+func (m migrationsByVersion) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m migrationsByVersion) Less(i, j int) bool { return m[i].Version < m[j].Version }
+
+// Migrations returns the embedded migrations, oldest first.
+func Migrations() ([]*Migration, error) {
+	byVersion := map[int]*Migration{}
+
+	for filename, content := range migrationFiles {
+		match := migrationFilenameRegexp.FindStringSubmatch(filename)
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration filename %q", filename)
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("conflicting names for migration %v: %q and %q",
+				version, m.Name, match[2])
+		}
+
+		switch match[3] {
+		case "up":
+			m.Up = content
+		case "down":
+			m.Down = content
+		}
+	}
+
+	migrations := []*Migration{}
+	for _, m := range byVersion {
+		migrations = append(migrations, m)
+	}
+
+	sort.Sort(migrationsByVersion(migrations))
+	return migrations, nil
+}
+
+// SchemaVersion is the version of the newest embedded migration, which is
+// the version this build of account-sync expects to run against.
+func SchemaVersion() int {
+	migrations, err := Migrations()
+	if err != nil || len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+type Migrator struct {
+	db *DB
+}
+
+func NewMigrator(db *DB) *Migrator {
+	return &Migrator{db: db}
+}
+
+func (mg *Migrator) Up() error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+
+	applied, err := mg.appliedVersions()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		started := time.Now().UTC()
+		log.Printf("state=started migrate=up version=%v name=%v", m.Version, m.Name)
+
+		err = mg.run(m.Up, `
+			INSERT INTO account_sync_schema_migrations (version, applied_at)
+			VALUES ($1, $2)`, m.Version, time.Now().UTC())
+		if err != nil {
+			log.Printf("state=errored migrate=up version=%v name=%v err=%v", m.Version, m.Name, err)
+			return err
+		}
+
+		log.Printf("state=completed migrate=up version=%v name=%v duration=%v",
+			m.Version, m.Name, time.Now().UTC().Sub(started))
+	}
+
+	return nil
+}
+
+// Down rolls back the most recently applied migration.  Migrations without
+// a down migration, such as the baseline, cannot be rolled back.
+func (mg *Migrator) Down() error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+
+	current, err := mg.CurrentVersion()
+	if err != nil {
+		return err
+	}
+
+	if current == 0 {
+		return errNoMigrationsApplied
+	}
+
+	var m *Migration
+	for _, candidate := range migrations {
+		if candidate.Version == current {
+			m = candidate
+		}
+	}
+
+	if m == nil {
+		return fmt.Errorf("migration %v is not known to this version of account-sync", current)
+	}
+
+	if m.Version == 1 {
+		return errBaselineRollback
+	}
+	if m.Down == "" {
+		return fmt.Errorf("migration %v %v cannot be rolled back", m.Version, m.Name)
+	}
+
+	started := time.Now().UTC()
+	log.Printf("state=started migrate=down version=%v name=%v", m.Version, m.Name)
+
+	err = mg.run(m.Down, `DELETE FROM account_sync_schema_migrations WHERE version = $1`, m.Version)
+	if err != nil {
+		log.Printf("state=errored migrate=down version=%v name=%v err=%v", m.Version, m.Name, err)
+		return err
+	}
+
+	log.Printf("state=completed migrate=down version=%v name=%v duration=%v",
+		m.Version, m.Name, time.Now().UTC().Sub(started))
+	return nil
+}
+
+func (mg *Migrator) Status() ([]*MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := mg.appliedVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []*MigrationStatus{}
+	for _, m := range migrations {
+		status := &MigrationStatus{Migration: m}
+		if appliedAt, ok := applied[m.Version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+func (mg *Migrator) CurrentVersion() (int, error) {
+	err := mg.ensureVersionTable()
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = mg.db.Get(&version, `SELECT COALESCE(MAX(version), 0) FROM account_sync_schema_migrations`)
+	return version, err
+}
+
+// CheckSchemaVersion returns a *SchemaVersionError unless the database has
+// been migrated to exactly the version this build expects.
+func (mg *Migrator) CheckSchemaVersion() error {
+	current, err := mg.CurrentVersion()
+	if err != nil {
+		return err
+	}
+
+	expected := SchemaVersion()
+	if current != expected {
+		return &SchemaVersionError{Current: current, Expected: expected}
+	}
+
+	return nil
+}
+
+func (mg *Migrator) appliedVersions() (map[int]time.Time, error) {
+	err := mg.ensureVersionTable()
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []struct {
+		Version   int       `db:"version"`
+		AppliedAt time.Time `db:"applied_at"`
+	}{}
+	err = mg.db.Select(&rows, `SELECT version, applied_at FROM account_sync_schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := map[int]time.Time{}
+	for _, row := range rows {
+		applied[row.Version] = row.AppliedAt
+	}
+
+	return applied, nil
+}
+
+func (mg *Migrator) ensureVersionTable() error {
+	_, err := mg.db.Exec(`
+		CREATE TABLE IF NOT EXISTS account_sync_schema_migrations (
+			version integer PRIMARY KEY,
+			applied_at timestamp without time zone NOT NULL
+		)`)
+	return err
+}
+
+// run runs the script of a migration and then the statement recording it,
+// both in one transaction unless the script is marked to run without.
+func (mg *Migrator) run(script string, record string, args ...interface{}) error {
+	if !strings.HasPrefix(script, noTransactionMarker) {
+		return mg.inTx(func(tx *sqlx.Tx) error {
+			_, err := tx.Exec(script)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(record, args...)
+			return err
+		})
+	}
+
+	// a script of several statements is run as one implicit transaction
+	for _, statement := range splitStatements(script) {
+		_, err := mg.db.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := mg.db.Exec(record, args...)
+	return err
+}
+
+// splitStatements splits a migration script into its statements, leaving
+// out comment lines.  Statements end with a semicolon at the end of a line.
+func splitStatements(script string) []string {
+	statements := []string{}
+	lines := []string{}
+
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+
+		lines = append(lines, line)
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.Join(lines, "\n"))
+			lines = []string{}
+		}
+	}
+
+	if len(lines) > 0 {
+		statements = append(statements, strings.Join(lines, "\n"))
+	}
+
+	return statements
+}
+
+func (mg *Migrator) inTx(f func(*sqlx.Tx) error) error {
+	tx, err := mg.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = f(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,126 @@
+package accountsync
+
+import "testing"
+
+func TestMigrationsEmbedded(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("expected embedded migrations")
+	}
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("expected migration %v to have version %v, got %v", m.Name, i+1, m.Version)
+		}
+		if m.Up == "" {
+			t.Errorf("migration %v %v has no up migration", m.Version, m.Name)
+		}
+	}
+
+	if migrations[0].Down != "" {
+		t.Error("the baseline migration must not have a down migration")
+	}
+
+	if SchemaVersion() != migrations[len(migrations)-1].Version {
+		t.Errorf("expected schema version %v, got %v", migrations[len(migrations)-1].Version, SchemaVersion())
+	}
+}
+
+func TestMigrationsParsing(t *testing.T) {
+	embedded := migrationFiles
+	defer func() { migrationFiles = embedded }()
+
+	for _, tc := range []struct {
+		name     string
+		files    map[string]string
+		versions []int
+		fails    bool
+	}{
+		{
+			name: "sorted by version",
+			files: map[string]string{
+				"0010_ten.up.sql":   "SELECT 10",
+				"0002_two.up.sql":   "SELECT 2",
+				"0001_one.up.sql":   "SELECT 1",
+				"0002_two.down.sql": "SELECT -2",
+			},
+			versions: []int{1, 2, 10},
+		},
+		{
+			name:  "invalid filename",
+			files: map[string]string{"one.up.sql": "SELECT 1"},
+			fails: true,
+		},
+		{
+			name:  "unknown direction",
+			files: map[string]string{"0001_one.sideways.sql": "SELECT 1"},
+			fails: true,
+		},
+		{
+			name: "conflicting names",
+			files: map[string]string{
+				"0001_one.up.sql":   "SELECT 1",
+				"0001_uno.down.sql": "SELECT -1",
+			},
+			fails: true,
+		},
+	} {
+		migrationFiles = tc.files
+		migrations, err := Migrations()
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+
+		versions := []int{}
+		for _, m := range migrations {
+			versions = append(versions, m.Version)
+		}
+		if len(versions) != len(tc.versions) {
+			t.Errorf("%s: expected versions %v, got %v", tc.name, tc.versions, versions)
+			continue
+		}
+		for i := range versions {
+			if versions[i] != tc.versions[i] {
+				t.Errorf("%s: expected versions %v, got %v", tc.name, tc.versions, versions)
+				break
+			}
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := noTransactionMarker + `
+-- a comment
+DROP INDEX CONCURRENTLY IF EXISTS a;
+
+CREATE INDEX CONCURRENTLY a
+  ON b (c);
+ALTER INDEX a RENAME TO d`
+
+	statements := splitStatements(script)
+	expected := []string{
+		"DROP INDEX CONCURRENTLY IF EXISTS a;",
+		"CREATE INDEX CONCURRENTLY a\n  ON b (c);",
+		"ALTER INDEX a RENAME TO d",
+	}
+
+	if len(statements) != len(expected) {
+		t.Fatalf("expected %q, got %q", expected, statements)
+	}
+	for i := range statements {
+		if statements[i] != expected[i] {
+			t.Errorf("expected statement %v to be %q, got %q", i, expected[i], statements[i])
+		}
+	}
+}
@@ -3,6 +3,15 @@ package accountsync
 import (
 	"database/sql"
 	"time"
+
+	"github.com/google/go-github/github"
+)
+
+const (
+	// repositoriesSyncReasonOverLimit is recorded on organizations with more
+	// public repositories than OrganizationsRepositoriesLimit, whose
+	// repositories are only synced a few pages at a time.
+	repositoriesSyncReasonOverLimit = "over_repositories_limit"
 )
 
 type Organization struct {
@@ -18,4 +27,35 @@ type Organization struct {
 	Email     sql.NullString `db:"email"`
 	Company   sql.NullString `db:"company"`
 	Homepage  sql.NullString `db:"homepage"`
+
+	GithubInstallationID       sql.NullInt64  `db:"github_installation_id"`
+	PublicRepos                sql.NullInt64  `db:"public_repos"`
+	Large                      sql.NullBool   `db:"large"`
+	RepositoriesSyncPage       sql.NullInt64  `db:"repositories_sync_page"`
+	RepositoriesSyncReason     sql.NullString `db:"repositories_sync_reason"`
+	RepositoriesSyncedAt       *time.Time     `db:"repositories_synced_at"`
+	RepositoriesSweepStartedAt *time.Time     `db:"repositories_sweep_started_at"`
+}
+
+func (org *Organization) UpdateFromGithubOrganization(ghOrg *github.Organization, reposLimit int) {
+	org.AvatarURL = sql.NullString{String: strPtrOrEmpty(ghOrg.AvatarURL), Valid: true}
+	org.Company = sql.NullString{String: strPtrOrEmpty(ghOrg.Company), Valid: true}
+	org.Email = sql.NullString{String: strPtrOrEmpty(ghOrg.Email), Valid: true}
+	org.GithubID = sql.NullInt64{Int64: int64(*ghOrg.ID), Valid: true}
+	org.Homepage = sql.NullString{String: strPtrOrEmpty(ghOrg.Blog), Valid: true}
+	org.Location = sql.NullString{String: strPtrOrEmpty(ghOrg.Location), Valid: true}
+	org.Login = sql.NullString{String: strPtrOrEmpty(ghOrg.Login), Valid: true}
+	org.Name = sql.NullString{String: strPtrOrEmpty(ghOrg.Name), Valid: true}
+
+	org.PublicRepos = sql.NullInt64{}
+	if ghOrg.PublicRepos != nil {
+		org.PublicRepos = sql.NullInt64{Int64: int64(*ghOrg.PublicRepos), Valid: true}
+	}
+
+	large := org.PublicRepos.Valid && org.PublicRepos.Int64 > int64(reposLimit)
+	org.Large = sql.NullBool{Bool: large, Valid: true}
+	org.RepositoriesSyncReason = sql.NullString{}
+	if large {
+		org.RepositoriesSyncReason = sql.NullString{String: repositoriesSyncReasonOverLimit, Valid: true}
+	}
 }
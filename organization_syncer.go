@@ -1,9 +1,12 @@
 package accountsync
 
 import (
+	"database/sql"
 	"log"
+	"time"
 
 	"github.com/google/go-github/github"
+	"golang.org/x/net/context"
 )
 
 type OrganizationSyncer struct {
@@ -12,22 +15,24 @@ type OrganizationSyncer struct {
 }
 
 type orgSyncContext struct {
+	runCtx  context.Context
 	user    *User
 	client  *github.Client
-	curOrgs map[string]*Organization
-	ghOrgs  map[string]*github.Organization
+	curOrgs map[int64]*Organization
+	ghOrgs  map[int64]*github.Organization
 }
 
 func NewOrganizationSyncer(db *DB, cfg *Config) *OrganizationSyncer {
 	return &OrganizationSyncer{db: db, cfg: cfg}
 }
 
-func (osync *OrganizationSyncer) Sync(user *User, client *github.Client) error {
+func (osync *OrganizationSyncer) Sync(runCtx context.Context, user *User, client *github.Client) error {
 	ctx := &orgSyncContext{
+		runCtx:  runCtx,
 		user:    user,
 		client:  client,
-		curOrgs: map[string]*Organization{},
-		ghOrgs:  map[string]*github.Organization{},
+		curOrgs: map[int64]*Organization{},
+		ghOrgs:  map[int64]*github.Organization{},
 	}
 
 	err := user.HydrateOrganizations(osync.db)
@@ -36,7 +41,7 @@ func (osync *OrganizationSyncer) Sync(user *User, client *github.Client) error {
 	}
 
 	for _, org := range user.Organizations {
-		ctx.curOrgs[org.Login.String] = org
+		ctx.curOrgs[org.GithubID.Int64] = org
 	}
 
 	ghOrgs, err := osync.getGithubOrgs(ctx)
@@ -45,16 +50,59 @@ func (osync *OrganizationSyncer) Sync(user *User, client *github.Client) error {
 	}
 
 	for _, org := range ghOrgs {
-		ctx.ghOrgs[*org.Login] = org
+		ctx.ghOrgs[int64(*org.ID)] = org
 	}
 
-	for _, org := range user.Organizations {
-		log.Printf("sync=organizations login=%s org=%s", user.Login.String, org.Login.String)
-		// TODO: create or update org
-		// TODO: create new memberships
-		// TODO: remove outdated memberships
+	for githubID, ghOrg := range ctx.ghOrgs {
+		log.Printf("sync=organizations login=%s org=%s", user.Login.String, *ghOrg.Login)
+
+		org, err := osync.upsertOrg(ghOrg, ctx)
+		if err != nil {
+			return err
+		}
+
+		if org.Large.Bool {
+			log.Printf("level=warn sync=organizations login=%v org=%v public_repos=%v public_repos_limit=%v reason=%v",
+				user.Login.String, org.Login.String, org.PublicRepos.Int64,
+				osync.cfg.OrganizationsRepositoriesLimit, org.RepositoriesSyncReason.String)
+		}
+
+		if _, ok := ctx.curOrgs[githubID]; ok {
+			continue
+		}
+
+		log.Printf("action=creating sync=membership login=%v org=%v", user.Login.String, org.Login.String)
+		err = osync.createMembership(org, ctx)
+		if err != nil {
+			return err
+		}
+		countChange(ctx.runCtx, "memberships.created", 1)
+	}
+
+	// orgs missing from the listing may be private memberships the token
+	// cannot see, so they are only removed when it can
+	canRemove := user.CanListPrivateOrgs()
+	if !canRemove {
+		log.Printf("msg=\"not removing memberships, token lacks read:org\" sync=organizations login=%v",
+			user.Login.String)
+	}
+
+	for githubID, org := range ctx.curOrgs {
+		if _, ok := ctx.ghOrgs[githubID]; ok || !canRemove {
+			continue
+		}
+
+		log.Printf("action=removing sync=membership login=%v org=%v", user.Login.String, org.Login.String)
+		err = osync.removeMembership(org, ctx)
+		if err != nil {
+			return err
+		}
+		countChange(ctx.runCtx, "memberships.removed", 1)
 	}
 
+	// the memberships changed, so the repositories sync needs to reload them
+	user.Organizations = nil
+
 	return nil
 }
 
@@ -76,12 +124,25 @@ func (osync *OrganizationSyncer) getGithubOrgs(ctx *orgSyncContext) ([]*github.O
 	listOpts := &github.ListOptions{Page: 1, PerPage: 100}
 
 	for {
+		// nothing has been written yet, so this is a clean point to stop at
+		err := contextErr(ctx.runCtx)
+		if err != nil {
+			return allOrgs, err
+		}
+
 		ghOrgs, resp, err := ctx.client.Organizations.List("", listOpts)
 		if err != nil {
 			return allOrgs, err
 		}
 
 		for _, org := range ghOrgs {
+			err := checkGithubOrg(&org)
+			if err != nil {
+				log.Printf("level=warn msg=\"skipping org\" sync=organizations login=%v page=%v err=%v",
+					ctx.user.Login.String, listOpts.Page, err)
+				continue
+			}
+
 			log.Printf("msg=\"fetching full org\" sync=organizations login=%v page=%v org=%v",
 				ctx.user.Login.String, listOpts.Page, *org.Login)
 
@@ -90,12 +151,11 @@ func (osync *OrganizationSyncer) getGithubOrgs(ctx *orgSyncContext) ([]*github.O
 				return allOrgs, err
 			}
 
-			if *fullOrg.PublicRepos > osync.cfg.OrganizationsRepositoriesLimit {
-				log.Printf("msg=\"skipping org\" sync=organizations login=%v page=%v org=%v public_repos=%v public_repos_limit=%v",
-					ctx.user.Login.String, listOpts.Page, *fullOrg.Login, *fullOrg.PublicRepos,
-					osync.cfg.OrganizationsRepositoriesLimit)
-				continue
+			err = checkGithubOrg(fullOrg)
+			if err != nil {
+				return allOrgs, err
 			}
+
 			allOrgs = append(allOrgs, fullOrg)
 		}
 
@@ -108,3 +168,128 @@ func (osync *OrganizationSyncer) getGithubOrgs(ctx *orgSyncContext) ([]*github.O
 
 	return allOrgs, nil
 }
+
+func (osync *OrganizationSyncer) upsertOrg(ghOrg *github.Organization, ctx *orgSyncContext) (*Organization, error) {
+	now := time.Now().UTC()
+	org := &Organization{
+		CreatedAt: &now,
+		UpdatedAt: &now,
+	}
+	org.UpdateFromGithubOrganization(ghOrg, osync.cfg.OrganizationsRepositoriesLimit)
+
+	err := osync.db.Get(&org.ID, `
+		INSERT INTO organizations (
+			avatar_url, company, created_at, email, github_id, homepage, large,
+			location, login, name, public_repos, repositories_sync_reason, updated_at
+		) VALUES (
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13
+		)
+		ON CONFLICT (github_id) DO UPDATE SET
+			avatar_url = EXCLUDED.avatar_url,
+			company = EXCLUDED.company,
+			email = EXCLUDED.email,
+			homepage = EXCLUDED.homepage,
+			large = EXCLUDED.large,
+			location = EXCLUDED.location,
+			login = EXCLUDED.login,
+			name = EXCLUDED.name,
+			public_repos = EXCLUDED.public_repos,
+			repositories_sync_reason = EXCLUDED.repositories_sync_reason,
+			updated_at = EXCLUDED.updated_at
+		RETURNING id
+	`, org.AvatarURL, org.Company, org.CreatedAt, org.Email, org.GithubID, org.Homepage,
+		org.Large, org.Location, org.Login, org.Name, org.PublicRepos,
+		org.RepositoriesSyncReason, org.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	osync.db.InvalidateOrg(*ghOrg.ID)
+	return org, nil
+}
+
+func (osync *OrganizationSyncer) createMembership(org *Organization, ctx *orgSyncContext) error {
+	_, err := osync.db.Exec(`
+		INSERT INTO memberships (organization_id, user_id)
+		SELECT $1, $2
+		WHERE NOT EXISTS (
+			SELECT 1 FROM memberships WHERE organization_id = $1 AND user_id = $2
+		)`, org.ID, ctx.user.ID)
+	return err
+}
+
+func (osync *OrganizationSyncer) removeMembership(org *Organization, ctx *orgSyncContext) error {
+	_, err := osync.db.Exec(`
+		DELETE FROM memberships WHERE organization_id = $1 AND user_id = $2
+	`, org.ID, ctx.user.ID)
+	return err
+}
+
+// AddMember records a membership of user in org, as when GitHub notifies us
+// of a member being added.
+func (osync *OrganizationSyncer) AddMember(org *Organization, user *User) error {
+	return osync.createMembership(org, &orgSyncContext{user: user})
+}
+
+// RemoveMember removes the membership of user in org.
+func (osync *OrganizationSyncer) RemoveMember(org *Organization, user *User) error {
+	return osync.removeMembership(org, &orgSyncContext{user: user})
+}
+
+// RemoveAllMembers removes every membership in org, as when it has been
+// deleted on GitHub.
+func (osync *OrganizationSyncer) RemoveAllMembers(org *Organization) error {
+	_, err := osync.db.Exec(`DELETE FROM memberships WHERE organization_id = $1`, org.ID)
+	return err
+}
+
+// RenameOrg updates the login of an org and the owner name of its
+// repositories.
+func (osync *OrganizationSyncer) RenameOrg(org *Organization, login string) error {
+	tx, err := osync.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	_, err = tx.Exec(`UPDATE organizations SET login = $1, updated_at = $2 WHERE id = $3`,
+		login, now, org.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE repositories SET owner_name = $1, updated_at = $2
+		WHERE owner_type = 'Organization' AND owner_id = $3`, login, now, org.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	osync.db.InvalidateOrg(int(org.GithubID.Int64))
+	return nil
+}
+
+// SetInstallation records the GitHub App installation for org, or clears it
+// when installationID is 0.
+func (osync *OrganizationSyncer) SetInstallation(org *Organization, installationID int) error {
+	org.GithubInstallationID = sql.NullInt64{}
+	if installationID != 0 {
+		org.GithubInstallationID = sql.NullInt64{Int64: int64(installationID), Valid: true}
+	}
+
+	_, err := osync.db.Exec(`UPDATE organizations SET github_installation_id = $1 WHERE id = $2`,
+		org.GithubInstallationID, org.ID)
+	if err != nil {
+		return err
+	}
+
+	osync.db.InvalidateOrg(int(org.GithubID.Int64))
+	return nil
+}
@@ -1,6 +1,10 @@
 package accountsync
 
-import "fmt"
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
 
 type Owner struct {
 	Type         string
@@ -8,6 +12,16 @@ type Owner struct {
 	Organization *Organization
 }
 
+func (o *Owner) ID() sql.NullInt64 {
+	switch o.Type {
+	case "user":
+		return o.User.ID
+	case "organization":
+		return o.Organization.ID
+	}
+	panic(fmt.Errorf("invalid owner type %q", o.Type))
+}
+
 func (o *Owner) Key() string {
 	switch o.Type {
 	case "user":
@@ -27,3 +41,15 @@ func (o *Owner) String() string {
 	}
 	panic(fmt.Errorf("invalid owner type %q", o.Type))
 }
+
+// RepositoriesSyncedAt is when the last full sweep of the owner's
+// repositories started, or nil if there has not been one.
+func (o *Owner) RepositoriesSyncedAt() *time.Time {
+	switch o.Type {
+	case "user":
+		return o.User.RepositoriesSyncedAt
+	case "organization":
+		return o.Organization.RepositoriesSyncedAt
+	}
+	panic(fmt.Errorf("invalid owner type %q", o.Type))
+}
@@ -2,14 +2,18 @@ package accountsync
 
 import (
 	"fmt"
+	"log"
 	"strings"
 
 	"github.com/google/go-github/github"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
 )
 
 type OwnerRepositoriesSyncer struct {
 	db  *DB
 	cfg *Config
+	app *GithubApp
 }
 
 type ownerRepoSyncContext struct {
@@ -36,11 +40,11 @@ func (eos *errOrgSync) Error() string {
 	return strings.Join(s, "; ")
 }
 
-func NewOwnerRepositoriesSyncer(db *DB, cfg *Config) *OwnerRepositoriesSyncer {
-	return &OwnerRepositoriesSyncer{db: db, cfg: cfg}
+func NewOwnerRepositoriesSyncer(db *DB, cfg *Config, app *GithubApp) *OwnerRepositoriesSyncer {
+	return &OwnerRepositoriesSyncer{db: db, cfg: cfg, app: app}
 }
 
-func (ors *OwnerRepositoriesSyncer) Sync(user *User, client *github.Client) error {
+func (ors *OwnerRepositoriesSyncer) Sync(runCtx context.Context, user *User, client *github.Client) error {
 	ctx := &ownerRepoSyncContext{
 		user:   user,
 		client: client,
@@ -72,22 +76,45 @@ func (ors *OwnerRepositoriesSyncer) Sync(user *User, client *github.Client) erro
 	orgSyncErrors := map[string][]error{}
 
 	for _, owner := range owners {
+		err := contextErr(runCtx)
+		if err != nil {
+			return err
+		}
+
+		installationID := 0
 		addErr := func(err error) {
 			hadRepoSyncErr = true
 			key := owner.Key()
 			if _, ok := orgSyncErrors[key]; !ok {
 				orgSyncErrors[key] = []error{}
 			}
-			orgSyncErrors[key] = append(orgSyncErrors[key], err)
+			syncErr := newSyncError(err)
+			syncErr.Owner = owner.String()
+			syncErr.Installation = installationID
+			orgSyncErrors[key] = append(orgSyncErrors[key], syncErr)
 		}
 
 		rs := NewRepositoriesSyncer(ors.db, ors.cfg)
-		repoIDs, err := rs.Sync(owner, user, client)
+		ownerClient, installationID, err := ors.clientFor(runCtx, owner, client)
 		if err != nil {
 			addErr(err)
 			continue
 		}
 
+		repoIDs, err := rs.Sync(runCtx, owner, user, ownerClient)
+		if err == errSyncInterrupted || err == errSyncTimedOut {
+			return err
+		}
+		if ers, ok := err.(*errRepoSync); ok {
+			// the other repositories were synced, so their IDs count
+			for _, repoErr := range ers.errs {
+				addErr(repoErr)
+			}
+		} else if err != nil {
+			addErr(err)
+			continue
+		}
+
 		if repoIDs != nil {
 			githubRepoIDs = append(githubRepoIDs, repoIDs...)
 		}
@@ -105,6 +132,39 @@ func (ors *OwnerRepositoriesSyncer) Sync(user *User, client *github.Client) erro
 	return nil
 }
 
+// clientFor returns the client to list the owner's repositories with, which
+// is an installation client for orgs that installed the GitHub App, and the
+// user's own client otherwise.  Installations not recorded by a webhook are
+// looked up as the app.  The ID of the installation used is returned, which
+// is 0 for the user's client.
+func (ors *OwnerRepositoriesSyncer) clientFor(runCtx context.Context, owner *Owner, userClient *github.Client) (*github.Client, int, error) {
+	if ors.app == nil || owner.Type != "organization" {
+		return userClient, 0, nil
+	}
+
+	installationID := int(owner.Organization.GithubInstallationID.Int64)
+	if !owner.Organization.GithubInstallationID.Valid {
+		var err error
+		installationID, err = ors.app.OrgInstallationID(owner.Organization.Login.String)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if installationID == 0 {
+		return userClient, 0, nil
+	}
+
+	log.Printf("level=debug msg=\"using installation token\" sync=repositories owner=%v installation_id=%v",
+		owner, installationID)
+	ts := ors.app.InstallationTokenSource(installationID)
+	client, err := newGithubClientWithTransport(ors.cfg, &deadlineTransport{
+		ctx:  runCtx,
+		base: &oauth2.Transport{Source: ts},
+	})
+	return client, installationID, err
+}
+
 func (ors *OwnerRepositoriesSyncer) cleanupRepos(githubRepoIDs []*int, ctx *ownerRepoSyncContext) error {
 	// TODO: find old repos and revoke all permissions for the user
 	return nil
@@ -0,0 +1,65 @@
+package accountsync
+
+import (
+	"database/sql"
+)
+
+// Permission is what a user may do with a repository, as GitHub reports it
+// in the permissions of the repositories listed for the user.
+// The permissions table belongs to Travis; account-sync only reads it.
+type Permission struct {
+	ID           sql.NullInt64 `db:"id"`
+	UserID       sql.NullInt64 `db:"user_id"`
+	RepositoryID sql.NullInt64 `db:"repository_id"`
+	Admin        sql.NullBool  `db:"admin"`
+	Push         sql.NullBool  `db:"push"`
+	Pull         sql.NullBool  `db:"pull"`
+}
+
+// PermissionFromGithubRepository returns the permission GitHub reports the
+// user to have on the repository, or nil if it reports none.
+func PermissionFromGithubRepository(ghRepo *GithubRepository) *Permission {
+	if ghRepo.Permissions == nil {
+		return nil
+	}
+
+	perms := *ghRepo.Permissions
+	return &Permission{
+		Admin: sql.NullBool{Bool: perms["admin"], Valid: true},
+		Push:  sql.NullBool{Bool: perms["push"], Valid: true},
+		Pull:  sql.NullBool{Bool: perms["pull"], Valid: true},
+	}
+}
+
+// Equal reports whether both grant the same access, where missing flags
+// grant nothing.
+func (perm *Permission) Equal(other *Permission) bool {
+	return perm.Admin.Bool == other.Admin.Bool &&
+		perm.Push.Bool == other.Push.Bool &&
+		perm.Pull.Bool == other.Pull.Bool
+}
+
+func (perm *Permission) String() string {
+	s := ""
+	for _, flag := range []struct {
+		name string
+		set  bool
+	}{
+		{"admin", perm.Admin.Bool},
+		{"push", perm.Push.Bool},
+		{"pull", perm.Pull.Bool},
+	} {
+		if !flag.set {
+			continue
+		}
+		if s != "" {
+			s += ","
+		}
+		s += flag.name
+	}
+
+	if s == "" {
+		return "none"
+	}
+	return s
+}
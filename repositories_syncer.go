@@ -4,15 +4,60 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/google/go-github/github"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/net/context"
+)
+
+const (
+	githubTopicsMediaType = "application/vnd.github.mercy-preview+json"
+)
+
+var (
+	errUnknownRepoOwner = fmt.Errorf("the repository owner is not known yet")
 )
 
 type repoSyncContext struct {
+	runCtx context.Context
 	owner  *Owner
 	user   *User
 	client *github.Client
+
+	startedAt time.Time
+	// sweepStartedAt is when the full sweep started, which is before
+	// startedAt when a large org is swept over several syncs, and nil when
+	// that is not known.
+	sweepStartedAt *time.Time
+	// full is true for a full sweep of the owner's repositories; otherwise
+	// only the ones updated since the last full sweep are read.
+	full      bool
+	since     *time.Time
+	paused    bool
+	hadErrors bool
+	// errs holds the failures of single repositories and pages, which do
+	// not stop the sync of the owner's other repositories.
+	errs []error
+	// readOnly keeps unknown owners from being created, for comparing with
+	// GitHub without writing.
+	readOnly bool
+}
+
+// errRepoSync holds the failures of single repositories and pages of an
+// owner's sync, which went on past them.
+type errRepoSync struct {
+	errs []error
+}
+
+func (ers *errRepoSync) Error() string {
+	s := []string{}
+	for _, err := range ers.errs {
+		s = append(s, err.Error())
+	}
+	return strings.Join(s, "; ")
 }
 
 type RepositoriesSyncer struct {
@@ -27,14 +72,26 @@ func NewRepositoriesSyncer(db *DB, cfg *Config) *RepositoriesSyncer {
 	}
 }
 
-func (rs *RepositoriesSyncer) Sync(owner *Owner, user *User, client *github.Client) ([]*int, error) {
+func (rs *RepositoriesSyncer) Sync(runCtx context.Context, owner *Owner, user *User, client *github.Client) ([]*int, error) {
 	ctx := &repoSyncContext{
-		owner:  owner,
-		user:   user,
-		client: client,
+		runCtx:    runCtx,
+		owner:     owner,
+		user:      user,
+		client:    client,
+		startedAt: time.Now().UTC(),
 	}
+	ctx.sweepStartedAt = &ctx.startedAt
 	githubRepoIDs := []*int{}
 
+	since := owner.RepositoriesSyncedAt()
+	ctx.full = since == nil || ctx.startedAt.Sub(*since) >= rs.cfg.RepositoriesFullSyncInterval
+	if !ctx.full {
+		ctx.since = since
+	}
+
+	log.Printf("msg=\"syncing repositories\" sync=repositories full=%v since=%v owner=%v login=%v",
+		ctx.full, since, owner, user.Login.String)
+
 	for _, syncType := range rs.cfg.SyncTypes {
 		syncTypeGithubIDs, err := rs.syncReposOfType(syncType, ctx)
 		if err != nil {
@@ -43,14 +100,51 @@ func (rs *RepositoriesSyncer) Sync(owner *Owner, user *User, client *github.Clie
 		githubRepoIDs = append(githubRepoIDs, syncTypeGithubIDs...)
 	}
 
+	if ctx.full && !ctx.paused && !ctx.hadErrors && ctx.sweepStartedAt != nil {
+		err := rs.saveRepositoriesSyncedAt(ctx)
+		if err != nil {
+			return githubRepoIDs, err
+		}
+	}
+
+	if len(ctx.errs) > 0 {
+		return githubRepoIDs, &errRepoSync{errs: ctx.errs}
+	}
+
 	return githubRepoIDs, nil
 }
+
 func (rs *RepositoriesSyncer) syncReposOfType(syncType string, ctx *repoSyncContext) ([]*int, error) {
 	curPage := rs.cfg.RepositoriesStartPage
+	pageLimit := 0
+	pages := 0
+	sort, direction := "updated", "desc"
+
+	// a large org is swept a few pages per sync, in an order which does not
+	// shift between syncs
+	large := ctx.full && ctx.owner.Type == "organization" && ctx.owner.Organization.Large.Bool
+	if large {
+		if ctx.owner.Organization.RepositoriesSyncPage.Valid {
+			curPage = int(ctx.owner.Organization.RepositoriesSyncPage.Int64)
+			// changes to the pages swept by earlier syncs are only caught
+			// when relative to when the sweep started
+			ctx.sweepStartedAt = ctx.owner.Organization.RepositoriesSweepStartedAt
+		}
+		pageLimit = rs.cfg.LargeOrganizationsPagesPerSync
+		sort, direction = "full_name", "asc"
+		log.Printf("msg=\"syncing large org incrementally\" sync=repositories page=%v page_limit=%v owner=%v login=%v",
+			curPage, pageLimit, ctx.owner, ctx.user.Login.String)
+	}
+
+	if !ctx.full {
+		curPage = 1
+	}
 
 	for {
 		opts := &github.RepositoryListOptions{
-			Type: syncType,
+			Type:      syncType,
+			Sort:      sort,
+			Direction: direction,
 			ListOptions: github.ListOptions{
 				PerPage: 100,
 				Page:    curPage,
@@ -60,53 +154,274 @@ func (rs *RepositoriesSyncer) syncReposOfType(syncType string, ctx *repoSyncCont
 		log.Printf("sync=repositories page=%v owner=%v login=%v",
 			curPage, ctx.owner, ctx.user.Login.String)
 
-		var (
-			repos    []github.Repository
-			response *github.Response
-			err      error
-		)
-
-		switch ctx.owner.Type {
-		case "user":
-			repos, response, err = rs.getUserRepositories(opts, ctx)
-		case "organization":
-			repos, response, err = rs.getOrganizationRepositories(opts, ctx)
-		default:
-			panic(fmt.Errorf("invalid owner type %q", ctx.owner.Type))
-		}
-
+		repos, response, err := rs.listRepositories(opts, ctx)
 		if err != nil {
+			ctx.hadErrors = true
 			log.Printf("level=error sync=repositories page=%v owner=%v login=%v err=%v",
 				curPage, ctx.owner, ctx.user.Login.String, err)
-			continue
+			return nil, err
+		}
+
+		reachedUnchanged := false
+		if ctx.since != nil {
+			repos, reachedUnchanged = rs.takeReposChangedSince(*ctx.since, repos)
 		}
 
-		for _, repo := range repos {
-			err = rs.syncRepo(&repo, ctx)
+		started := time.Now().UTC()
+		log.Printf("state=started sync=repositories_page page=%v owner=%v login=%v",
+			curPage, ctx.owner, ctx.user.Login.String)
+
+		pageRepos := []*Repository{}
+		for i := range repos {
+			repo, err := rs.prepareRepo(&repos[i], ctx)
 			if err != nil {
-				log.Printf("level=error sync=repository repo_id=%v login=%v repo=%v err=%v",
-					*repo.ID, ctx.user.Login.String, *repo.FullName, err)
+				rs.addRepoErr(int64(intPtrOrZero(repos[i].ID)), repos[i].Slug(), err, ctx)
+				continue
+			}
+
+			if repo != nil {
+				pageRepos = append(pageRepos, repo)
 			}
 		}
 
+		changedRepos, unchangedRepos, created, err := rs.partitionUnchangedRepos(pageRepos, ctx)
+		if err == nil {
+			err = rs.upsertRepos(changedRepos, ctx)
+		}
+		if err == nil {
+			err = rs.stampLastSync(unchangedRepos, ctx)
+		}
+
+		if err != nil {
+			ctx.hadErrors = true
+			ctx.errs = append(ctx.errs, err)
+			log.Printf("level=error sync=repositories page=%v owner=%v login=%v err=%v",
+				curPage, ctx.owner, ctx.user.Login.String, err)
+		} else {
+			updated := len(changedRepos) - created
+			countChange(ctx.runCtx, "repositories.created", created)
+			countChange(ctx.runCtx, "repositories.updated", updated)
+			countChange(ctx.runCtx, "repositories.unchanged", len(unchangedRepos))
+			log.Printf("state=completed sync=repositories_page page=%v owner=%v login=%v "+
+				"created=%v updated=%v unchanged=%v duration=%v",
+				curPage, ctx.owner, ctx.user.Login.String, created, updated, len(unchangedRepos),
+				time.Now().UTC().Sub(started))
+		}
+
+		pages += 1
+
+		if reachedUnchanged {
+			log.Printf("msg=\"reached repositories unchanged since last full sync\" sync=repositories page=%v owner=%v login=%v",
+				curPage, ctx.owner, ctx.user.Login.String)
+			break
+		}
+
 		if response.NextPage == 0 {
+			if large {
+				return nil, rs.saveRepositoriesSyncPage(0, ctx)
+			}
 			break
 		}
 
 		curPage += 1
+
+		if stopErr := contextErr(ctx.runCtx); stopErr != nil {
+			log.Printf("msg=\"stopping repositories sync\" sync=repositories next_page=%v owner=%v login=%v reason=%v",
+				curPage, ctx.owner, ctx.user.Login.String, stopErr)
+			ctx.paused = true
+			if large {
+				err = rs.saveRepositoriesSyncPage(curPage, ctx)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return nil, stopErr
+		}
+
+		if pageLimit > 0 && pages >= pageLimit {
+			log.Printf("msg=\"pausing large org sync\" sync=repositories next_page=%v owner=%v login=%v",
+				curPage, ctx.owner, ctx.user.Login.String)
+			ctx.paused = true
+			return nil, rs.saveRepositoriesSyncPage(curPage, ctx)
+		}
 	}
 	return nil, nil
 }
 
-func (rs *RepositoriesSyncer) getUserRepositories(opts *github.RepositoryListOptions, ctx *repoSyncContext) ([]github.Repository, *github.Response, error) {
-	return ctx.client.Repositories.List("", opts)
+// SyncRepository writes a single repository outside of a listing, as when
+// GitHub notifies us of a change to it.  The client may be nil, in which
+// case unknown owners and fork parents are not looked up.
+func (rs *RepositoriesSyncer) SyncRepository(ghRepo *GithubRepository, user *User, client *github.Client) error {
+	ctx := &repoSyncContext{
+		runCtx:    context.Background(),
+		user:      user,
+		client:    client,
+		startedAt: time.Now().UTC(),
+	}
+
+	err := checkGithubRepo(ghRepo)
+	if err != nil {
+		return err
+	}
+
+	if !rs.shouldSync(ghRepo) {
+		// still record visibility changes of repositories we know about
+		_, err := rs.db.Exec(`UPDATE repositories SET private = $1, updated_at = $2 WHERE github_id = $3`,
+			ghRepo.IsPrivate(), ctx.startedAt, *ghRepo.ID)
+		return err
+	}
+
+	owner, err := rs.findRepoOwner(ghRepo, ctx)
+	if err != nil {
+		return err
+	}
+	ctx.owner = owner
+
+	repo, err := rs.prepareRepo(ghRepo, ctx)
+	if err != nil || repo == nil {
+		return err
+	}
+
+	changedRepos, unchangedRepos, _, err := rs.partitionUnchangedRepos([]*Repository{repo}, ctx)
+	if err != nil {
+		return err
+	}
+
+	err = rs.upsertRepos(changedRepos, ctx)
+	if err != nil {
+		return err
+	}
+
+	err = rs.stampLastSync(unchangedRepos, ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(ctx.errs) > 0 {
+		return &errRepoSync{errs: ctx.errs}
+	}
+	return nil
 }
 
-func (rs *RepositoriesSyncer) getOrganizationRepositories(opts *github.RepositoryListOptions, ctx *repoSyncContext) ([]github.Repository, *github.Response, error) {
-	repos := []github.Repository{}
-	reqURL := fmt.Sprintf("/organizations/%v/repos?page=%v&per_page=%v&type=%s",
-		ctx.owner.Organization.GithubID, opts.ListOptions.Page, opts.ListOptions.PerPage, opts.Type)
-	req, err := ctx.client.NewRequest("GET", reqURL, nil)
+// addRepoErr records the failure of a single repository, which the sync of
+// the owner's other repositories goes on past.
+func (rs *RepositoriesSyncer) addRepoErr(githubID int64, slug string, err error, ctx *repoSyncContext) {
+	ctx.hadErrors = true
+	syncErr := &SyncError{
+		Kind:  classifyError(err),
+		Login: ctx.user.Login.String,
+		Stage: "repositories",
+		Repo:  slug,
+		Err:   err,
+	}
+	if ctx.owner != nil {
+		syncErr.Owner = ctx.owner.String()
+	}
+	ctx.errs = append(ctx.errs, syncErr)
+	log.Printf("level=error sync=repository repo_id=%v login=%v repo=%v kind=%v err=%v",
+		githubID, ctx.user.Login.String, slug, syncErr.Kind, err)
+}
+
+// MarkRepositoryDeleted records that a repository has been deleted on GitHub.
+func (rs *RepositoriesSyncer) MarkRepositoryDeleted(ghRepoID int) error {
+	now := time.Now().UTC()
+	_, err := rs.db.Exec(`
+		UPDATE repositories SET deleted_at = $1, updated_at = $1
+		WHERE github_id = $2 AND deleted_at IS NULL`, now, ghRepoID)
+	return err
+}
+
+// takeReposChangedSince returns the leading repositories of a page sorted
+// by most recently updated which were updated after since, and whether the
+// rest of the listing can be skipped.  Only updated_at is compared, as that
+// is what the listing is sorted by, so pushes which leave it unchanged are
+// picked up by the next full sweep.
+func (rs *RepositoriesSyncer) takeReposChangedSince(since time.Time, repos []GithubRepository) ([]GithubRepository, bool) {
+	for i, repo := range repos {
+		if repo.UpdatedAt != nil && repo.UpdatedAt.After(since) {
+			continue
+		}
+		return repos[:i], true
+	}
+	return repos, false
+}
+
+// saveRepositoriesSyncedAt records the start of a completed full sweep of the
+// owner's repositories, which incremental syncs are relative to.
+func (rs *RepositoriesSyncer) saveRepositoriesSyncedAt(ctx *repoSyncContext) error {
+	var err error
+	switch ctx.owner.Type {
+	case "user":
+		_, err = rs.db.Exec(`UPDATE users SET repositories_synced_at = $1 WHERE id = $2`,
+			ctx.sweepStartedAt, ctx.owner.User.ID)
+		ctx.owner.User.RepositoriesSyncedAt = ctx.sweepStartedAt
+		rs.db.InvalidateUser(int(ctx.owner.User.GithubID.Int64))
+	case "organization":
+		_, err = rs.db.Exec(`UPDATE organizations SET repositories_synced_at = $1 WHERE id = $2`,
+			ctx.sweepStartedAt, ctx.owner.Organization.ID)
+		ctx.owner.Organization.RepositoriesSyncedAt = ctx.sweepStartedAt
+		rs.db.InvalidateOrg(int(ctx.owner.Organization.GithubID.Int64))
+	}
+	return err
+}
+
+// saveRepositoriesSyncPage records the page the next sync of a large org
+// resumes from, along with when the sweep started, with 0 meaning it starts
+// over from the first page.
+func (rs *RepositoriesSyncer) saveRepositoriesSyncPage(page int, ctx *repoSyncContext) error {
+	org := ctx.owner.Organization
+	org.RepositoriesSyncPage = sql.NullInt64{}
+	org.RepositoriesSweepStartedAt = nil
+	if page > 0 {
+		org.RepositoriesSyncPage = sql.NullInt64{Int64: int64(page), Valid: true}
+		org.RepositoriesSweepStartedAt = ctx.sweepStartedAt
+	}
+
+	_, err := rs.db.Exec(`
+		UPDATE organizations SET repositories_sync_page = $1, repositories_sweep_started_at = $2
+		WHERE id = $3`, org.RepositoriesSyncPage, org.RepositoriesSweepStartedAt, org.ID)
+	if err != nil {
+		return err
+	}
+
+	rs.db.InvalidateOrg(int(org.GithubID.Int64))
+	return nil
+}
+
+func (rs *RepositoriesSyncer) listRepositories(opts *github.RepositoryListOptions, ctx *repoSyncContext) ([]GithubRepository, *github.Response, error) {
+	switch ctx.owner.Type {
+	case "user":
+		return rs.getUserRepositories(opts, ctx)
+	case "organization":
+		return rs.getOrganizationRepositories(opts, ctx)
+	}
+
+	panic(fmt.Errorf("invalid owner type %q", ctx.owner.Type))
+}
+
+func (rs *RepositoriesSyncer) getUserRepositories(opts *github.RepositoryListOptions, ctx *repoSyncContext) ([]GithubRepository, *github.Response, error) {
+	repos := []GithubRepository{}
+	reqURL := fmt.Sprintf("user/repos?page=%v&per_page=%v&type=%s&sort=%s&direction=%s",
+		opts.ListOptions.Page, opts.ListOptions.PerPage, opts.Type, opts.Sort, opts.Direction)
+	req, err := rs.newRepositoryRequest(reqURL, ctx)
+	if err != nil {
+		return repos, nil, err
+	}
+
+	response, err := ctx.client.Do(req, &repos)
+	if err != nil {
+		return repos, response, err
+	}
+
+	return repos, response, err
+}
+
+func (rs *RepositoriesSyncer) getOrganizationRepositories(opts *github.RepositoryListOptions, ctx *repoSyncContext) ([]GithubRepository, *github.Response, error) {
+	repos := []GithubRepository{}
+	reqURL := fmt.Sprintf("organizations/%v/repos?page=%v&per_page=%v&type=%s&sort=%s&direction=%s",
+		ctx.owner.Organization.GithubID.Int64, opts.ListOptions.Page, opts.ListOptions.PerPage, opts.Type,
+		opts.Sort, opts.Direction)
+	req, err := rs.newRepositoryRequest(reqURL, ctx)
 	if err != nil {
 		return repos, nil, err
 	}
@@ -119,71 +434,277 @@ func (rs *RepositoriesSyncer) getOrganizationRepositories(opts *github.Repositor
 	return repos, response, err
 }
 
-func (rs *RepositoriesSyncer) shouldSync(repo *github.Repository) bool {
+func (rs *RepositoriesSyncer) getGithubRepository(fullName string, ctx *repoSyncContext) (*GithubRepository, error) {
+	req, err := rs.newRepositoryRequest(fmt.Sprintf("repos/%s", fullName), ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := &GithubRepository{}
+	_, err = ctx.client.Do(req, repo)
+	if err != nil {
+		return repo, err
+	}
+
+	return repo, err
+}
+
+// newRepositoryRequest builds a GET request which asks for the repository
+// topics as well, as they are still behind a preview media type.
+func (rs *RepositoriesSyncer) newRepositoryRequest(reqURL string, ctx *repoSyncContext) (*http.Request, error) {
+	req, err := ctx.client.NewRequest("GET", reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", githubTopicsMediaType)
+	return req, nil
+}
+
+func (rs *RepositoriesSyncer) shouldSync(repo *GithubRepository) bool {
 	t := "public"
-	if *repo.Private {
+	if repo.IsPrivate() {
 		t = "private"
 	}
 	return sliceContains(rs.cfg.SyncTypes, t)
 }
 
-func (rs *RepositoriesSyncer) syncRepo(ghRepo *github.Repository, ctx *repoSyncContext) error {
+// prepareRepo resolves the owner of a GitHub repository and maps it onto a
+// Repository ready to be upserted.  A nil Repository means it is skipped,
+// which repositories whose owner cannot be resolved are, so that the stored
+// owner_id is left alone.
+func (rs *RepositoriesSyncer) prepareRepo(ghRepo *GithubRepository, ctx *repoSyncContext) (*Repository, error) {
+	err := checkGithubRepo(ghRepo)
+	if err != nil {
+		return nil, err
+	}
+
 	log.Printf("sync=repository repo_id=%v login=%v repo=%v\n",
-		*ghRepo.ID, ctx.user.Login.String, *ghRepo.FullName)
+		*ghRepo.ID, ctx.user.Login.String, ghRepo.Slug())
 	if !rs.shouldSync(ghRepo) {
 		log.Printf("msg=\"skipping\" sync=repository repo_id=%v login=%v repo=%v\n",
-			*ghRepo.ID, ctx.user.Login.String, *ghRepo.FullName)
-		return nil
+			*ghRepo.ID, ctx.user.Login.String, ghRepo.Slug())
+		return nil, nil
 	}
 
-	started := time.Now().UTC()
-	log.Printf("state=started sync=repository repo_id=%v login=%v repo=%v",
-		*ghRepo.ID, ctx.user.Login.String, *ghRepo.FullName)
-
 	owner, err := rs.findRepoOwner(ghRepo, ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if owner == nil && ctx.client == nil {
+		return nil, errUnknownRepoOwner
 	}
 
-	if owner == nil {
+	if owner == nil && !ctx.readOnly {
 		owner, err = rs.createRepoOwner(ghRepo, ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if owner == nil {
+			log.Printf("level=warn msg=\"skipping repository with unknown owner\" sync=repository repo_id=%v login=%v repo=%v owner_type=%v",
+				*ghRepo.ID, ctx.user.Login.String, ghRepo.Slug(), strPtrOrEmpty(ghRepo.Owner.Type))
+			return nil, nil
+		}
+	}
+
+	now := time.Now().UTC()
+	repo := &Repository{
+		CreatedAt: &now,
+		LastSync:  &ctx.startedAt,
+		UpdatedAt: &now,
 	}
 
-	repo, err := rs.findRepoByGithubID(*ghRepo.ID, ctx)
+	err = repo.UpdateFromGithubRepository(ghRepo)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if repo == nil {
-		log.Printf("action=creating sync=repository repo_id=%v login=%v repo=%v",
-			*ghRepo.ID, ctx.user.Login.String, *ghRepo.FullName)
-		repo, err = rs.createRepo(ghRepo, ctx)
-		if err != nil {
-			return err
-		}
-	} else {
-		log.Printf("action=updating sync=repository repo_id=%v login=%v repo=%v",
-			*ghRepo.ID, ctx.user.Login.String, *ghRepo.FullName)
-		repo.UpdateFromGithubRepository(ghRepo)
-		repo, err = rs.updateRepo(repo, ctx)
-		if err != nil {
-			return err
-		}
+	if owner != nil {
+		repo.OwnerID = owner.ID()
 	}
 
 	// TODO: sync permissions if present
 	// TODO: permit if permittable
 
+	return repo, nil
+}
+
+// partitionUnchangedRepos compares a page of repositories with their stored
+// rows and splits off the unchanged ones, so that they are not written
+// again.  It also returns how many of the changed ones are new.
+func (rs *RepositoriesSyncer) partitionUnchangedRepos(repos []*Repository, ctx *repoSyncContext) ([]*Repository, []*Repository, int, error) {
+	if len(repos) == 0 {
+		return repos, repos, 0, nil
+	}
+
+	githubIDs := []int64{}
+	for _, repo := range repos {
+		githubIDs = append(githubIDs, repo.GithubID.Int64)
+	}
+
+	query, args, err := sqlx.In(`SELECT * FROM repositories WHERE github_id IN (?)`, githubIDs)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	stored := []*Repository{}
+	err = rs.db.Select(&stored, rs.db.Rebind(query), args...)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	storedByGithubID := map[int64]*Repository{}
+	for _, repo := range stored {
+		storedByGithubID[repo.GithubID.Int64] = repo
+	}
+
+	changed := []*Repository{}
+	unchanged := []*Repository{}
+	created := 0
+	for _, repo := range repos {
+		storedRepo, ok := storedByGithubID[repo.GithubID.Int64]
+
+		if repo.MissesForkParent() {
+			if ok {
+				repo.CopyForkParent(storedRepo)
+			}
+			if !ok || !storedRepo.ParentGithubID.Valid || !repo.SyncedFieldsEqual(storedRepo) {
+				err = rs.fetchForkParent(repo, ctx)
+				if err != nil {
+					rs.addRepoErr(repo.GithubID.Int64, repo.Slug(), err, ctx)
+					continue
+				}
+			}
+		}
+
+		if !ok {
+			created++
+			changed = append(changed, repo)
+			continue
+		}
+
+		if repo.SyncedFieldsEqual(storedRepo) {
+			log.Printf("level=debug action=unchanged sync=repository repo_id=%v login=%v repo=%v",
+				repo.GithubID.Int64, ctx.user.Login.String, repo.Name.String)
+			repo.ID = storedRepo.ID
+			unchanged = append(unchanged, repo)
+			continue
+		}
+
+		repo.ID = storedRepo.ID
+		changed = append(changed, repo)
+	}
+
+	return changed, unchanged, created, nil
+}
+
+// stampLastSync records that unchanged repositories have been synced,
+// without touching their updated_at.
+// fetchForkParent reads the parent and source of a fork, which listings of
+// repositories leave out.
+func (rs *RepositoriesSyncer) fetchForkParent(repo *Repository, ctx *repoSyncContext) error {
+	if ctx.client == nil {
+		return nil
+	}
+
+	log.Printf("level=debug sync=repository msg=\"fetching fork parent\" repo_id=%v repo=%v",
+		repo.GithubID.Int64, repo.Slug())
+	fullRepo, err := rs.getGithubRepository(repo.Slug(), ctx)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("state=completed sync=repository repo_id=%v login=%v repo=%v duration=%v",
-		*ghRepo.ID, ctx.user.Login.String, *ghRepo.FullName, time.Now().UTC().Sub(started))
+	repo.UpdateForkParentFromGithubRepository(fullRepo)
 	return nil
 }
 
-func (rs *RepositoriesSyncer) findRepoOwner(ghRepo *github.Repository, ctx *repoSyncContext) (*Owner, error) {
+func (rs *RepositoriesSyncer) stampLastSync(repos []*Repository, ctx *repoSyncContext) error {
+	if len(repos) == 0 {
+		return nil
+	}
+
+	ids := []int64{}
+	for _, repo := range repos {
+		ids = append(ids, repo.ID.Int64)
+	}
+
+	query, args, err := sqlx.In(`UPDATE repositories SET last_sync = ? WHERE id IN (?)`,
+		ctx.startedAt, ids)
+	if err != nil {
+		return err
+	}
+
+	_, err = rs.db.Exec(rs.db.Rebind(query), args...)
+	return err
+}
+
+// upsertRepos writes a page of repositories in a single statement, creating
+// the ones not known yet and updating the others, and sets their IDs.
+func (rs *RepositoriesSyncer) upsertRepos(repos []*Repository, ctx *repoSyncContext) error {
+	byGithubID := map[int64]*Repository{}
+	for _, repo := range repos {
+		byGithubID[repo.GithubID.Int64] = repo
+	}
+
+	if len(byGithubID) == 0 {
+		return nil
+	}
+
+	values := []string{}
+	args := []interface{}{}
+	for _, repo := range byGithubID {
+		placeholders := []string{}
+		for _, arg := range repo.upsertArgs() {
+			args = append(args, arg)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+		}
+		values = append(values, fmt.Sprintf("(%s)", strings.Join(placeholders, ", ")))
+	}
+
+	updates := []string{}
+	for _, column := range repositoryUpsertColumns {
+		if column == "created_at" {
+			continue
+		}
+		updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", column, column))
+	}
+
+	query := fmt.Sprintf(`
+		INSERT INTO repositories (%s)
+		VALUES %s
+		ON CONFLICT (github_id) DO UPDATE SET %s
+		RETURNING id, github_id`,
+		strings.Join(repositoryUpsertColumns, ", "),
+		strings.Join(values, ", "),
+		strings.Join(updates, ", "))
+
+	log.Printf("action=upserting sync=repositories owner=%v login=%v count=%v",
+		ctx.owner, ctx.user.Login.String, len(byGithubID))
+
+	rows, err := rs.db.Queryx(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, githubID int64
+		err = rows.Scan(&id, &githubID)
+		if err != nil {
+			return err
+		}
+
+		if repo, ok := byGithubID[githubID]; ok {
+			repo.ID = sql.NullInt64{Int64: id, Valid: true}
+		}
+	}
+
+	return rows.Err()
+}
+
+func (rs *RepositoriesSyncer) findRepoOwner(ghRepo *GithubRepository, ctx *repoSyncContext) (*Owner, error) {
 	owner := &Owner{}
 
 	log.Printf("level=debug sync=repository msg=\"finding user\" github_id=%v", *ghRepo.Owner.ID)
@@ -213,105 +734,24 @@ func (rs *RepositoriesSyncer) findRepoOwner(ghRepo *github.Repository, ctx *repo
 	return nil, nil
 }
 
-func (rs *RepositoriesSyncer) findRepoByGithubID(ghRepoID int, ctx *repoSyncContext) (*Repository, error) {
-	repo := &Repository{}
-	err := rs.db.Get(repo, `SELECT * FROM repositories WHERE github_id = $1`, ghRepoID)
-	if err == sql.ErrNoRows {
-		repo = nil
-		err = nil
-	}
-	return repo, err
-}
-
-func (rs *RepositoriesSyncer) createRepo(ghRepo *github.Repository, ctx *repoSyncContext) (*Repository, error) {
-	now := time.Now().UTC()
-	repo := &Repository{
-		CreatedAt: &now,
-		UpdatedAt: &now,
-	}
-	repo.UpdateFromGithubRepository(ghRepo)
-
-	res, err := rs.db.NamedExec(`
-		INSERT INTO repositories (
-			created_at,
-			default_branch,
-			description,
-			github_id,
-			github_language,
-			name,
-			owner_id,
-			owner_name,
-			owner_type,
-			private,
-			url,
-			updated_at
-		) VALUES (
-			:created_at,
-			:default_branch,
-			:description,
-			:github_id,
-			:github_language,
-			:name,
-			:owner_id,
-			:owner_name,
-			:owner_type,
-			:private,
-			:url,
-			:updated_at
-		) RETURNING id
-	`, repo)
-	if err != nil {
-		return nil, err
-	}
-
-	id, err := res.LastInsertId()
-	if err != nil {
-		return nil, err
-	}
-	repo.ID = sql.NullInt64{Int64: int64(id), Valid: true}
-
-	return repo, nil
-}
-
-func (rs *RepositoriesSyncer) updateRepo(repo *Repository, ctx *repoSyncContext) (*Repository, error) {
-	now := time.Now().UTC()
-	repo.UpdatedAt = &now
-	_, err := rs.db.NamedExec(`
-		UPDATE repositories
-		SET
-			default_branch = :default_branch,
-			description = :description,
-			github_id = :github_id,
-			github_language = :github_language,
-			name = :name,
-			owner_id = :owner_id,
-			owner_name = :owner_name,
-			owner_type = :owner_type,
-			private = :private,
-			url = :url,
-			updated_at = :updated_at
-		WHERE id = :id
-	`, repo)
-	return repo, err
-}
-
-func (rs *RepositoriesSyncer) createRepoOwner(repo *github.Repository, ctx *repoSyncContext) (*Owner, error) {
-	switch *repo.Owner.Type {
+func (rs *RepositoriesSyncer) createRepoOwner(repo *GithubRepository, ctx *repoSyncContext) (*Owner, error) {
+	switch strPtrOrEmpty(repo.Owner.Type) {
 	case "User":
 		ghUser, err := rs.getGithubUserByID(*repo.Owner.ID, ctx)
 		if err != nil {
 			return nil, err
 		}
 		user, err := rs.createUserFromGithubUser(ghUser, ctx)
-		if err != nil {
+		if err != nil || user == nil {
 			return nil, err
 		}
+		rs.db.InvalidateUser(*repo.Owner.ID)
 		owner := &Owner{
 			Type: "user",
 			User: user,
 		}
 		log.Printf("level=warn login=%v id=%v sync=repository slug=%v status=created_user reason=owner_not_found",
-			user.Login, user.ID, *repo.FullName)
+			user.Login, user.ID, repo.Slug())
 		return owner, nil
 	case "Organization":
 		ghOrg, err := rs.getGithubOrgByID(*repo.Owner.ID, ctx)
@@ -319,15 +759,16 @@ func (rs *RepositoriesSyncer) createRepoOwner(repo *github.Repository, ctx *repo
 			return nil, err
 		}
 		org, err := rs.createOrgFromGithubOrg(ghOrg, ctx)
-		if err != nil {
+		if err != nil || org == nil {
 			return nil, err
 		}
+		rs.db.InvalidateOrg(*repo.Owner.ID)
 		owner := &Owner{
 			Type:         "organization",
 			Organization: org,
 		}
 		log.Printf("level=warn login=%v id=%v sync=repository slug=%v status=created_org reason=owner_not_found",
-			org.Login, org.ID, *repo.FullName)
+			org.Login, org.ID, repo.Slug())
 		return owner, nil
 	}
 
@@ -335,7 +776,7 @@ func (rs *RepositoriesSyncer) createRepoOwner(repo *github.Repository, ctx *repo
 }
 
 func (rs *RepositoriesSyncer) getGithubUserByID(userID int, ctx *repoSyncContext) (*github.User, error) {
-	reqURL := fmt.Sprintf("/user/%v", userID)
+	reqURL := fmt.Sprintf("user/%v", userID)
 	req, err := ctx.client.NewRequest("GET", reqURL, nil)
 	if err != nil {
 		return nil, err
@@ -351,7 +792,7 @@ func (rs *RepositoriesSyncer) getGithubUserByID(userID int, ctx *repoSyncContext
 }
 
 func (rs *RepositoriesSyncer) getGithubOrgByID(orgID int, ctx *repoSyncContext) (*github.Organization, error) {
-	reqURL := fmt.Sprintf("/organizations/%v", orgID)
+	reqURL := fmt.Sprintf("organizations/%v", orgID)
 	req, err := ctx.client.NewRequest("GET", reqURL, nil)
 	if err != nil {
 		return nil, err
@@ -366,10 +807,40 @@ func (rs *RepositoriesSyncer) getGithubOrgByID(orgID int, ctx *repoSyncContext)
 	return org, err
 }
 
+// createUserFromGithubUser stores the owner of a repository who never signed
+// in, so without a token, which leaves them out of syncs.
 func (rs *RepositoriesSyncer) createUserFromGithubUser(ghUser *github.User, ctx *repoSyncContext) (*User, error) {
-	return nil, nil
+	err := checkGithubUser(ghUser)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes, err := dumpGithubScopes([]string{})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	user := &User{}
+	err = rs.db.Get(user, `
+		INSERT INTO users (name, login, email, created_at, updated_at, github_id, gravatar_id, github_scopes)
+		VALUES ($1, $2, $3, $4, $4, $5, $6, $7)
+		ON CONFLICT (github_id) DO UPDATE SET github_id = EXCLUDED.github_id
+		RETURNING *`,
+		strPtrOrEmpty(ghUser.Name), *ghUser.Login, strPtrOrEmpty(ghUser.Email), now, *ghUser.ID,
+		strPtrOrEmpty(ghUser.GravatarID), scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, user.Hydrate()
 }
 
 func (rs *RepositoriesSyncer) createOrgFromGithubOrg(ghOrg *github.Organization, ctx *repoSyncContext) (*Organization, error) {
-	return nil, nil
+	err := checkGithubOrg(ghOrg)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewOrganizationSyncer(rs.db, rs.cfg).upsertOrg(ghOrg, &orgSyncContext{user: ctx.user})
 }
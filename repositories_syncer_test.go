@@ -0,0 +1,48 @@
+package accountsync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func testGithubRepo(id int, updatedAt *time.Time) GithubRepository {
+	repo := GithubRepository{}
+	repo.ID = &id
+	if updatedAt != nil {
+		repo.UpdatedAt = &github.Timestamp{Time: *updatedAt}
+	}
+	return repo
+}
+
+func TestTakeReposChangedSince(t *testing.T) {
+	since := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	before := since.Add(-time.Hour)
+	after := since.Add(time.Hour)
+
+	for _, tc := range []struct {
+		name      string
+		updatedAt []*time.Time
+		taken     int
+		reached   bool
+	}{
+		{name: "empty", updatedAt: []*time.Time{}, taken: 0},
+		{name: "all changed", updatedAt: []*time.Time{&after, &after}, taken: 2},
+		{name: "cut off at first unchanged", updatedAt: []*time.Time{&after, &before, &after}, taken: 1, reached: true},
+		{name: "updated exactly at since is unchanged", updatedAt: []*time.Time{&since}, taken: 0, reached: true},
+		{name: "missing updated_at is unchanged", updatedAt: []*time.Time{&after, nil}, taken: 1, reached: true},
+	} {
+		repos := []GithubRepository{}
+		for i, updatedAt := range tc.updatedAt {
+			repos = append(repos, testGithubRepo(i+1, updatedAt))
+		}
+
+		rs := &RepositoriesSyncer{}
+		taken, reached := rs.takeReposChangedSince(since, repos)
+		if len(taken) != tc.taken || reached != tc.reached {
+			t.Errorf("%s: expected %v repos and reached %v, got %v and %v",
+				tc.name, tc.taken, tc.reached, len(taken), reached)
+		}
+	}
+}
@@ -5,17 +5,82 @@ import (
 	"time"
 
 	"github.com/google/go-github/github"
+	"gopkg.in/yaml.v2"
 )
 
+// GithubRepository is a github.Repository extended with the fields the
+// vendored go-github does not know about yet.
+type GithubRepository struct {
+	github.Repository
+
+	Archived *bool    `json:"archived,omitempty"`
+	Disabled *bool    `json:"disabled,omitempty"`
+	Topics   []string `json:"topics,omitempty"`
+}
+
+// IsPrivate reports whether the repository is private, erring on the side
+// of private when GitHub leaves the visibility out.
+func (ghRepo *GithubRepository) IsPrivate() bool {
+	return ghRepo.Private == nil || *ghRepo.Private
+}
+
+// Slug returns the full name of the repository, falling back to the owner
+// and repository names.
+func (ghRepo *GithubRepository) Slug() string {
+	if ghRepo.FullName != nil {
+		return *ghRepo.FullName
+	}
+
+	ownerLogin := ""
+	if ghRepo.Owner != nil {
+		ownerLogin = strPtrOrEmpty(ghRepo.Owner.Login)
+	}
+	return ownerLogin + "/" + strPtrOrEmpty(ghRepo.Name)
+}
+
+// repositoryUpsertColumns are the columns written when upserting a
+// repository, in the order of the values returned by upsertArgs.
+var repositoryUpsertColumns = []string{
+	"archived",
+	"created_at",
+	"default_branch",
+	"deleted_at",
+	"description",
+	"disabled",
+	"fork",
+	"github_id",
+	"github_language",
+	"homepage",
+	"last_sync",
+	"name",
+	"owner_id",
+	"owner_name",
+	"owner_type",
+	"parent_github_id",
+	"parent_slug",
+	"private",
+	"pushed_at",
+	"source_github_id",
+	"source_slug",
+	"topics",
+	"url",
+	"updated_at",
+}
+
 type Repository struct {
 	ID sql.NullInt64 `db:"id"`
 
 	Active              sql.NullBool   `db:"active"`
+	Archived            sql.NullBool   `db:"archived"`
 	CreatedAt           *time.Time     `db:"created_at"`
 	DefaultBranch       sql.NullString `db:"default_branch"`
+	DeletedAt           *time.Time     `db:"deleted_at"`
 	Description         sql.NullString `db:"description"`
+	Disabled            sql.NullBool   `db:"disabled"`
+	Fork                sql.NullBool   `db:"fork"`
 	GithubID            sql.NullInt64  `db:"github_id"`
 	GithubLanguage      sql.NullString `db:"github_language"`
+	Homepage            sql.NullString `db:"homepage"`
 	LastBuildDuration   sql.NullInt64  `db:"last_build_duration"`
 	LastBuildFinishedAt *time.Time     `db:"last_build_finished_at"`
 	LastBuildID         sql.NullInt64  `db:"last_build_id"`
@@ -29,21 +94,187 @@ type Repository struct {
 	OwnerID             sql.NullInt64  `db:"owner_id"`
 	OwnerName           sql.NullString `db:"owner_name"`
 	OwnerType           sql.NullString `db:"owner_type"`
+	ParentGithubID      sql.NullInt64  `db:"parent_github_id"`
+	ParentSlug          sql.NullString `db:"parent_slug"`
 	Private             sql.NullBool   `db:"private"`
+	PushedAt            *time.Time     `db:"pushed_at"`
 	Settings            sql.NullString `db:"settings"`
+	SourceGithubID      sql.NullInt64  `db:"source_github_id"`
+	SourceSlug          sql.NullString `db:"source_slug"`
+	TopicsYAML          sql.NullString `db:"topics"`
 	URL                 sql.NullString `db:"url"`
 	UpdatedAt           *time.Time     `db:"updated_at"`
+
+	Topics []string `db:"-"`
+}
+
+func (repo *Repository) Hydrate() error {
+	if repo.Topics != nil {
+		return nil
+	}
+
+	repo.Topics = []string{}
+
+	if !repo.TopicsYAML.Valid {
+		return nil
+	}
+
+	return yaml.Unmarshal([]byte(repo.TopicsYAML.String), &repo.Topics)
+}
+
+// UpdateFromGithubRepository sets the fields GitHub knows about.  The owner
+// is referred to by its Travis id, which is left to the caller as it needs
+// the owner resolved, and by its login.
+// UpdateForkParentFromGithubRepository sets the parent and source of a fork,
+// which GitHub only includes when a single repository is read.
+func (repo *Repository) UpdateForkParentFromGithubRepository(ghRepo *GithubRepository) {
+	repo.ParentGithubID = sql.NullInt64{}
+	repo.ParentSlug = sql.NullString{}
+	if ghRepo.Parent != nil && ghRepo.Parent.ID != nil {
+		repo.ParentGithubID = sql.NullInt64{Int64: int64(*ghRepo.Parent.ID), Valid: true}
+		repo.ParentSlug = sql.NullString{String: strPtrOrEmpty(ghRepo.Parent.FullName), Valid: true}
+	}
+
+	repo.SourceGithubID = sql.NullInt64{}
+	repo.SourceSlug = sql.NullString{}
+	if ghRepo.Source != nil && ghRepo.Source.ID != nil {
+		repo.SourceGithubID = sql.NullInt64{Int64: int64(*ghRepo.Source.ID), Valid: true}
+		repo.SourceSlug = sql.NullString{String: strPtrOrEmpty(ghRepo.Source.FullName), Valid: true}
+	}
 }
 
-func (repo *Repository) UpdateFromGithubRepository(ghRepo *github.Repository) {
+// MissesForkParent reports whether the repository is a fork whose parent
+// was not part of the payload it was read from.
+func (repo *Repository) MissesForkParent() bool {
+	return repo.Fork.Bool && !repo.ParentGithubID.Valid
+}
+
+// CopyForkParent takes the parent and source of a fork from other, as they
+// are stored, instead of reading them from GitHub again.
+func (repo *Repository) CopyForkParent(other *Repository) {
+	repo.ParentGithubID = other.ParentGithubID
+	repo.ParentSlug = other.ParentSlug
+	repo.SourceGithubID = other.SourceGithubID
+	repo.SourceSlug = other.SourceSlug
+}
+
+// Slug returns the full name of the repository.
+func (repo *Repository) Slug() string {
+	return repo.OwnerName.String + "/" + repo.Name.String
+}
+
+func (repo *Repository) UpdateFromGithubRepository(ghRepo *GithubRepository) error {
+	err := checkGithubRepo(ghRepo)
+	if err != nil {
+		return err
+	}
+
+	repo.Archived = sql.NullBool{Bool: boolPtrOrFalse(ghRepo.Archived), Valid: true}
 	repo.DefaultBranch = sql.NullString{String: strPtrOrEmpty(ghRepo.DefaultBranch), Valid: true}
 	repo.Description = sql.NullString{String: strPtrOrEmpty(ghRepo.Description), Valid: true}
+	repo.Disabled = sql.NullBool{Bool: boolPtrOrFalse(ghRepo.Disabled), Valid: true}
+	repo.Fork = sql.NullBool{Bool: boolPtrOrFalse(ghRepo.Fork), Valid: true}
 	repo.GithubID = sql.NullInt64{Int64: int64(*ghRepo.ID), Valid: true}
 	repo.GithubLanguage = sql.NullString{String: strPtrOrEmpty(ghRepo.Language), Valid: true}
+	repo.Homepage = sql.NullString{String: strPtrOrEmpty(ghRepo.Homepage), Valid: true}
 	repo.Name = sql.NullString{String: strPtrOrEmpty(ghRepo.Name), Valid: true}
-	repo.OwnerID = sql.NullInt64{Int64: int64(*ghRepo.Owner.ID), Valid: true}
-	repo.OwnerName = sql.NullString{String: strPtrOrEmpty(ghRepo.Owner.Name), Valid: true}
+	repo.OwnerName = sql.NullString{String: strPtrOrEmpty(ghRepo.Owner.Login), Valid: true}
 	repo.OwnerType = sql.NullString{String: strPtrOrEmpty(ghRepo.Owner.Type), Valid: true}
-	repo.Private = sql.NullBool{Bool: *ghRepo.Private, Valid: true}
-	repo.URL = sql.NullString{String: strPtrOrEmpty(ghRepo.Homepage), Valid: true}
+	repo.Private = sql.NullBool{Bool: ghRepo.IsPrivate(), Valid: true}
+	repo.URL = sql.NullString{String: strPtrOrEmpty(ghRepo.HTMLURL), Valid: true}
+
+	repo.PushedAt = nil
+	if ghRepo.PushedAt != nil {
+		pushedAt := ghRepo.PushedAt.UTC()
+		repo.PushedAt = &pushedAt
+	}
+
+	repo.UpdateForkParentFromGithubRepository(ghRepo)
+
+	topics := ghRepo.Topics
+	if topics == nil {
+		topics = []string{}
+	}
+
+	topicsYAML, err := yaml.Marshal(topics)
+	if err != nil {
+		return err
+	}
+
+	repo.Topics = topics
+	repo.TopicsYAML = sql.NullString{String: string(topicsYAML), Valid: true}
+	return nil
+}
+
+func (repo *Repository) upsertArgs() []interface{} {
+	return []interface{}{
+		repo.Archived,
+		repo.CreatedAt,
+		repo.DefaultBranch,
+		repo.DeletedAt,
+		repo.Description,
+		repo.Disabled,
+		repo.Fork,
+		repo.GithubID,
+		repo.GithubLanguage,
+		repo.Homepage,
+		repo.LastSync,
+		repo.Name,
+		repo.OwnerID,
+		repo.OwnerName,
+		repo.OwnerType,
+		repo.ParentGithubID,
+		repo.ParentSlug,
+		repo.Private,
+		repo.PushedAt,
+		repo.SourceGithubID,
+		repo.SourceSlug,
+		repo.TopicsYAML,
+		repo.URL,
+		repo.UpdatedAt,
+	}
+}
+
+// SyncedFieldsEqual reports whether repo and other agree on every field
+// written by a sync, ignoring timestamps of the rows themselves and of the
+// syncs.
+func (repo *Repository) SyncedFieldsEqual(other *Repository) bool {
+	return len(repo.DifferingSyncedFields(other)) == 0
+}
+
+// DifferingSyncedFields returns the columns of the synced fields which
+// differ between the repositories.
+func (repo *Repository) DifferingSyncedFields(other *Repository) []string {
+	fields := []string{}
+	for _, field := range []struct {
+		column string
+		equal  bool
+	}{
+		{"archived", repo.Archived == other.Archived},
+		{"default_branch", repo.DefaultBranch == other.DefaultBranch},
+		{"deleted_at", timePtrsEqual(repo.DeletedAt, other.DeletedAt)},
+		{"description", repo.Description == other.Description},
+		{"disabled", repo.Disabled == other.Disabled},
+		{"fork", repo.Fork == other.Fork},
+		{"github_id", repo.GithubID == other.GithubID},
+		{"github_language", repo.GithubLanguage == other.GithubLanguage},
+		{"homepage", repo.Homepage == other.Homepage},
+		{"name", repo.Name == other.Name},
+		{"owner_id", repo.OwnerID == other.OwnerID},
+		{"owner_name", repo.OwnerName == other.OwnerName},
+		{"owner_type", repo.OwnerType == other.OwnerType},
+		{"parent_github_id", repo.ParentGithubID == other.ParentGithubID},
+		{"parent_slug", repo.ParentSlug == other.ParentSlug},
+		{"private", repo.Private == other.Private},
+		{"pushed_at", timePtrsEqual(repo.PushedAt, other.PushedAt)},
+		{"source_github_id", repo.SourceGithubID == other.SourceGithubID},
+		{"source_slug", repo.SourceSlug == other.SourceSlug},
+		{"topics", repo.TopicsYAML == other.TopicsYAML},
+		{"url", repo.URL == other.URL},
+	} {
+		if !field.equal {
+			fields = append(fields, field.column)
+		}
+	}
+	return fields
 }
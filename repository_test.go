@@ -0,0 +1,45 @@
+package accountsync
+
+import "testing"
+
+func TestRepositoryMissesForkParent(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload string
+		misses  bool
+	}{
+		{"not a fork", `{"id":1,"owner":{"id":2}}`, false},
+		{"fork from a listing", `{"id":1,"fork":true,"owner":{"id":2}}`, true},
+		{"fork read on its own", `{"id":1,"fork":true,"owner":{"id":2},"parent":{"id":3,"full_name":"o/p"}}`, false},
+	} {
+		repo := &Repository{}
+		err := repo.UpdateFromGithubRepository(decodeGithubRepo(t, tc.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if repo.MissesForkParent() != tc.misses {
+			t.Errorf("%s: expected MissesForkParent() to be %v", tc.name, tc.misses)
+		}
+	}
+}
+
+func TestRepositoryCopyForkParent(t *testing.T) {
+	stored := &Repository{}
+	err := stored.UpdateFromGithubRepository(decodeGithubRepo(t,
+		`{"id":1,"fork":true,"owner":{"id":2},"parent":{"id":3,"full_name":"o/p"},"source":{"id":4,"full_name":"o/s"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := &Repository{}
+	err = repo.UpdateFromGithubRepository(decodeGithubRepo(t, `{"id":1,"fork":true,"owner":{"id":2}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo.CopyForkParent(stored)
+	if repo.MissesForkParent() || !repo.SyncedFieldsEqual(stored) {
+		t.Errorf("expected the stored parent to be taken, differing in %v", repo.DifferingSyncedFields(stored))
+	}
+}
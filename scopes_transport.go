@@ -0,0 +1,59 @@
+package accountsync
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// scopesTransport refreshes the stored scopes of a user from the
+// X-OAuth-Scopes header of the first response to the user's token, whichever
+// stage makes it, as scopes change when users re-authorize and the stored
+// ones gate what is synced.
+type scopesTransport struct {
+	db   *DB
+	user *User
+	base http.RoundTripper
+
+	mu      sync.Mutex
+	checked bool
+}
+
+func newScopesTransport(db *DB, user *User, base http.RoundTripper) *scopesTransport {
+	return &scopesTransport{db: db, user: user, base: base}
+}
+
+func (st *scopesTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := st.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	header, ok := resp.Header[http.CanonicalHeaderKey("X-OAuth-Scopes")]
+	if !ok {
+		return resp, err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.checked {
+		return resp, err
+	}
+	st.checked = true
+
+	scopesErr := st.user.UpdateScopes(st.db, parseGithubScopes(strings.Join(header, ",")))
+	if scopesErr != nil {
+		log.Printf("level=warn msg=\"updating scopes failed\" login=%v err=%v",
+			st.user.Login.String, scopesErr)
+	}
+
+	return resp, err
+}
+
+func (st *scopesTransport) CancelRequest(req *http.Request) {
+	if canceler, ok := st.base.(requestCanceler); ok {
+		canceler.CancelRequest(req)
+	}
+}
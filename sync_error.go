@@ -0,0 +1,199 @@
+package accountsync
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-github/github"
+	"github.com/lib/pq"
+)
+
+// ErrorKind is the class of a sync failure, which reporting, retries and
+// metrics act on instead of matching error messages.
+type ErrorKind string
+
+const (
+	ErrorUnauthorized ErrorKind = "unauthorized"
+	// ErrorForbidden covers missing permissions as well as orgs requiring
+	// SAML SSO the token is not authorized for.
+	ErrorForbidden    ErrorKind = "forbidden"
+	ErrorNotFound     ErrorKind = "not_found"
+	ErrorRateLimited  ErrorKind = "rate_limited"
+	ErrorTimeout      ErrorKind = "timeout"
+	ErrorDataMismatch ErrorKind = "data_mismatch"
+	ErrorDatabase     ErrorKind = "database"
+	ErrorOther        ErrorKind = "other"
+)
+
+// SyncError is a failure of a user's sync, classified by kind, with the
+// user, stage, owner and repository it came from where these apply.
+type SyncError struct {
+	Kind  ErrorKind
+	Login string
+	Stage string
+	Owner string
+	Repo  string
+	Err   error
+
+	// Installation is the GitHub App installation whose token the failed
+	// request was made with, or 0 for the user's own token.
+	Installation int
+}
+
+func (err *SyncError) Error() string {
+	return fmt.Sprintf("msg=\"sync failed\" kind=%v sync=%v login=%v owner=%v repo=%v err=%q",
+		err.Kind, err.Stage, err.Login, err.Owner, err.Repo, err.Err.Error())
+}
+
+// Temporary reports whether syncing again later may succeed without anyone
+// acting on the failure.
+func (err *SyncError) Temporary() bool {
+	switch err.Kind {
+	case ErrorRateLimited, ErrorTimeout, ErrorDatabase:
+		return true
+	}
+	return false
+}
+
+// RevokesUserToken reports whether GitHub rejected the user's own token as
+// bad credentials, or the token and its refresh token alike, as opposed to
+// an installation token or the token lacking access to something.
+func (err *SyncError) RevokesUserToken() bool {
+	if err.Kind != ErrorUnauthorized || err.Installation != 0 {
+		return false
+	}
+
+	switch e := unwrapURLError(err.Err).(type) {
+	case *github.ErrorResponse:
+		return e.Message == "Bad credentials"
+	case *tokenRevokedError:
+		return true
+	}
+	return false
+}
+
+// newSyncError classifies err.  A SyncError is returned as is, keeping
+// what it has been annotated with already.
+func newSyncError(err error) *SyncError {
+	if syncErr, ok := err.(*SyncError); ok {
+		return syncErr
+	}
+	return &SyncError{Kind: classifyError(err), Err: err}
+}
+
+// databaseError marks err as coming from the database, for the errors of
+// database/sql which are not told apart from others by their type.
+func databaseError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &SyncError{Kind: ErrorDatabase, Err: err}
+}
+
+// syncErrors flattens the errors of a stage, which holds one per owner for
+// the repositories stage, into SyncErrors of the user.
+func syncErrors(err error, login, stage string) []*SyncError {
+	errs := []error{err}
+	if eos, ok := err.(*errOrgSync); ok && eos.errMap != nil {
+		errs = []error{}
+		for _, ownerErrs := range *eos.errMap {
+			errs = append(errs, ownerErrs...)
+		}
+	}
+
+	syncErrs := []*SyncError{}
+	for _, err := range errs {
+		syncErr := newSyncError(err)
+		if syncErr.Login == "" {
+			syncErr.Login = login
+		}
+		if syncErr.Stage == "" {
+			syncErr.Stage = stage
+		}
+		syncErrs = append(syncErrs, syncErr)
+	}
+	return syncErrs
+}
+
+func classifyError(err error) ErrorKind {
+	switch e := err.(type) {
+	case *SyncError:
+		return e.Kind
+	case *url.Error:
+		return classifyError(e.Err)
+	case *tokenRevokedError:
+		return ErrorUnauthorized
+	case *github.ErrorResponse:
+		return classifyGithubResponse(e.Response, e.Message)
+	case *StageTimeoutError:
+		return ErrorTimeout
+	case *incompletePayloadError, *UserSyncError:
+		return ErrorDataMismatch
+	case *pq.Error:
+		return ErrorDatabase
+	case net.Error:
+		if e.Timeout() {
+			return ErrorTimeout
+		}
+	}
+
+	switch err {
+	case errSyncTimedOut, errEducationTimeout:
+		return ErrorTimeout
+	case sql.ErrNoRows, sql.ErrTxDone, driver.ErrBadConn:
+		return ErrorDatabase
+	}
+
+	return ErrorOther
+}
+
+// unwrapURLError returns the error of the transport that an http.Client
+// wraps the errors of requests in.
+func unwrapURLError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err
+	}
+	return err
+}
+
+// isTimeout reports whether a request failed by running out of time, past
+// the Timeout of its http.Client or the deadline of its stage.
+func isTimeout(err error) bool {
+	err = unwrapURLError(err)
+	if err == errSyncTimedOut {
+		return true
+	}
+
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// classifyGithubResponse tells rate limits apart from other refusals, as
+// GitHub answers both with 403 Forbidden.
+func classifyGithubResponse(resp *http.Response, message string) ErrorKind {
+	if resp == nil {
+		return ErrorOther
+	}
+
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return ErrorUnauthorized
+	case http.StatusForbidden:
+		if resp.Header.Get("X-RateLimit-Remaining") == "0" ||
+			strings.Contains(strings.ToLower(message), "rate limit") {
+			return ErrorRateLimited
+		}
+		return ErrorForbidden
+	case http.StatusNotFound:
+		return ErrorNotFound
+	case 429:
+		return ErrorRateLimited
+	}
+
+	return ErrorOther
+}
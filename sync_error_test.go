@@ -0,0 +1,88 @@
+package accountsync
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/lib/pq"
+)
+
+func testGithubError(status int, header http.Header, message string) *github.ErrorResponse {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &github.ErrorResponse{
+		Response: &http.Response{StatusCode: status, Header: header},
+		Message:  message,
+	}
+}
+
+type testNetError struct{ timeout bool }
+
+func (err *testNetError) Error() string   { return "net error" }
+func (err *testNetError) Timeout() bool   { return err.timeout }
+func (err *testNetError) Temporary() bool { return false }
+
+func TestClassifyError(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		kind ErrorKind
+	}{
+		{"unauthorized", testGithubError(401, nil, "Bad credentials"), ErrorUnauthorized},
+		{"forbidden", testGithubError(403, nil, "Resource protected by organization SAML enforcement"), ErrorForbidden},
+		{"rate limit header", testGithubError(403, http.Header{"X-Ratelimit-Remaining": {"0"}}, ""), ErrorRateLimited},
+		{"rate limit message", testGithubError(403, nil, "API rate limit exceeded for user"), ErrorRateLimited},
+		{"secondary rate limit", testGithubError(429, nil, ""), ErrorRateLimited},
+		{"not found", testGithubError(404, nil, "Not Found"), ErrorNotFound},
+		{"server error", testGithubError(502, nil, ""), ErrorOther},
+		{"no response", &github.ErrorResponse{}, ErrorOther},
+		{"stage timeout", &StageTimeoutError{Stage: "repositories", Timeout: time.Minute}, ErrorTimeout},
+		{"sync timed out", errSyncTimedOut, ErrorTimeout},
+		{"education timeout", errEducationTimeout, ErrorTimeout},
+		{"net timeout", &testNetError{timeout: true}, ErrorTimeout},
+		{"net error", &testNetError{}, ErrorOther},
+		{"wrapped net timeout", &url.Error{Op: "Get", URL: "https://api.github.com/user", Err: &testNetError{timeout: true}}, ErrorTimeout},
+		{"token revoked", &tokenRevokedError{Err: &tokenRefreshError{Code: "bad_refresh_token"}}, ErrorUnauthorized},
+		{"incomplete payload", &incompletePayloadError{Kind: "repository", Field: "id"}, ErrorDataMismatch},
+		{"user mismatch", &UserSyncError{}, ErrorDataMismatch},
+		{"postgres", &pq.Error{Code: "23505"}, ErrorDatabase},
+		{"no rows", sql.ErrNoRows, ErrorDatabase},
+		{"database", databaseError(fmt.Errorf("connection refused")), ErrorDatabase},
+		{"classified", &SyncError{Kind: ErrorForbidden, Err: fmt.Errorf("nope")}, ErrorForbidden},
+		{"other", fmt.Errorf("something"), ErrorOther},
+	} {
+		kind := classifyError(tc.err)
+		if kind != tc.kind {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.kind, kind)
+		}
+	}
+}
+
+func TestSyncErrorRevokesUserToken(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		err          error
+		installation int
+		revokes      bool
+	}{
+		{"bad credentials", testGithubError(401, nil, "Bad credentials"), 0, true},
+		{"installation token", testGithubError(401, nil, "Bad credentials"), 7, false},
+		{"other 401", testGithubError(401, nil, "Requires authentication"), 0, false},
+		{"forbidden", testGithubError(403, nil, "Bad credentials"), 0, false},
+		{"not a github error", &SyncError{Kind: ErrorUnauthorized, Err: fmt.Errorf("Bad credentials")}, 0, false},
+		{"refresh token refused", &url.Error{Op: "Get", URL: "https://api.github.com/user", Err: &tokenRevokedError{Err: &tokenRefreshError{Status: 200, Code: "bad_refresh_token"}}}, 0, true},
+		{"refresh failed", &url.Error{Op: "Get", URL: "https://api.github.com/user", Err: &tokenRefreshError{Status: 502}}, 0, false},
+	} {
+		syncErr := newSyncError(tc.err)
+		syncErr.Installation = tc.installation
+		if syncErr.RevokesUserToken() != tc.revokes {
+			t.Errorf("%s: expected RevokesUserToken() to be %v", tc.name, tc.revokes)
+		}
+	}
+}
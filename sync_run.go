@@ -0,0 +1,257 @@
+package accountsync
+
+import (
+	"database/sql"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	SyncRunRunning     = "running"
+	SyncRunCompleted   = "completed"
+	SyncRunErrored     = "errored"
+	SyncRunTimedOut    = "timed_out"
+	SyncRunInterrupted = "interrupted"
+	SyncRunSkipped     = "skipped"
+)
+
+type contextKey int
+
+const (
+	syncRunContextKey contextKey = iota
+)
+
+// SyncRun is the record of syncing one user, kept in sync_runs so that what
+// past syncs did can be looked up later.
+type SyncRun struct {
+	ID          sql.NullInt64  `db:"id"`
+	UserID      sql.NullInt64  `db:"user_id"`
+	Login       sql.NullString `db:"login"`
+	StartedAt   *time.Time     `db:"started_at"`
+	FinishedAt  *time.Time     `db:"finished_at"`
+	Status      sql.NullString `db:"status"`
+	StagesYAML  sql.NullString `db:"stages"`
+	ChangesYAML sql.NullString `db:"changes"`
+	ErrorsYAML  sql.NullString `db:"errors"`
+	Version     sql.NullString `db:"version"`
+	Host        sql.NullString `db:"host"`
+
+	Stages  []*SyncRunStage `db:"-"`
+	Changes map[string]int  `db:"-"`
+	Errors  []string        `db:"-"`
+
+	// EducationFailed is set when the education lookup failed and the
+	// stored value was kept.
+	EducationFailed bool `db:"-"`
+}
+
+type SyncRunStage struct {
+	Name    string  `yaml:"name"`
+	Status  string  `yaml:"status"`
+	Seconds float64 `yaml:"seconds"`
+	Error   string  `yaml:"error,omitempty"`
+}
+
+func newSyncRun(user *User) *SyncRun {
+	now := time.Now().UTC()
+	host, _ := os.Hostname()
+
+	return &SyncRun{
+		UserID:    user.ID,
+		Login:     user.Login,
+		StartedAt: &now,
+		Status:    sql.NullString{String: SyncRunRunning, Valid: true},
+		Version:   sql.NullString{String: VersionString, Valid: true},
+		Host:      sql.NullString{String: host, Valid: host != ""},
+
+		Stages:  []*SyncRunStage{},
+		Changes: map[string]int{},
+		Errors:  []string{},
+	}
+}
+
+// withSyncRun returns a context carrying run, so that the syncers count
+// their changes towards it.
+func withSyncRun(parent context.Context, run *SyncRun) context.Context {
+	return context.WithValue(parent, syncRunContextKey, run)
+}
+
+func syncRunFromContext(runCtx context.Context) *SyncRun {
+	run, _ := runCtx.Value(syncRunContextKey).(*SyncRun)
+	return run
+}
+
+func (run *SyncRun) Hydrate() error {
+	run.Stages = []*SyncRunStage{}
+	run.Changes = map[string]int{}
+	run.Errors = []string{}
+
+	for _, field := range []struct {
+		yaml sql.NullString
+		into interface{}
+	}{
+		{run.StagesYAML, &run.Stages},
+		{run.ChangesYAML, &run.Changes},
+		{run.ErrorsYAML, &run.Errors},
+	} {
+		if !field.yaml.Valid {
+			continue
+		}
+
+		err := yaml.Unmarshal([]byte(field.yaml.String), field.into)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddStage records the outcome of a stage which ran from started until now.
+func (run *SyncRun) AddStage(name string, started time.Time, err error) {
+	stage := &SyncRunStage{
+		Name:    name,
+		Status:  syncRunStatusOf(err),
+		Seconds: time.Now().UTC().Sub(started).Seconds(),
+	}
+	if err != nil {
+		stage.Error = err.Error()
+	}
+
+	run.Stages = append(run.Stages, stage)
+	if run.Status.String == SyncRunRunning && stage.Status != SyncRunCompleted {
+		run.Status.String = stage.Status
+	}
+}
+
+// SkipStage records a stage which did not run as an earlier one failed.
+func (run *SyncRun) SkipStage(name string) {
+	run.Stages = append(run.Stages, &SyncRunStage{Name: name, Status: SyncRunSkipped})
+}
+
+// AddNonFatalError records an error the sync went on despite, which does
+// not make the run errored.
+func (run *SyncRun) AddNonFatalError(err error) {
+	run.Errors = append(run.Errors, err.Error())
+}
+
+func (run *SyncRun) countChange(name string, delta int) {
+	if delta != 0 {
+		run.Changes[name] += delta
+	}
+}
+
+// Start inserts the run, so that syncs in progress show up as running.
+func (run *SyncRun) Start(db *DB) error {
+	err := run.dump()
+	if err != nil {
+		return err
+	}
+
+	return db.Get(&run.ID, `
+		INSERT INTO sync_runs (
+			user_id, login, started_at, finished_at, status, stages, changes, errors, version, host
+		) VALUES (
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10
+		)
+		RETURNING id
+	`, run.UserID, run.Login, run.StartedAt, run.FinishedAt, run.Status, run.StagesYAML,
+		run.ChangesYAML, run.ErrorsYAML, run.Version, run.Host)
+}
+
+// Finish stores the outcome of the run along with the errors of the user.
+func (run *SyncRun) Finish(db *DB, errs []error) error {
+	now := time.Now().UTC()
+	run.FinishedAt = &now
+
+	for _, err := range errs {
+		run.Errors = append(run.Errors, err.Error())
+	}
+
+	if run.Status.String == SyncRunRunning {
+		run.Status.String = SyncRunCompleted
+		if len(errs) > 0 {
+			run.Status.String = SyncRunErrored
+		}
+	}
+
+	err := run.dump()
+	if err != nil {
+		return err
+	}
+
+	if !run.ID.Valid {
+		// inserting it at the start failed
+		return run.Start(db)
+	}
+
+	_, err = db.Exec(`
+		UPDATE sync_runs
+		SET finished_at = $1, status = $2, stages = $3, changes = $4, errors = $5
+		WHERE id = $6
+	`, run.FinishedAt, run.Status, run.StagesYAML, run.ChangesYAML, run.ErrorsYAML, run.ID)
+	return err
+}
+
+func (run *SyncRun) dump() error {
+	stagesYAML, err := yaml.Marshal(run.Stages)
+	if err != nil {
+		return err
+	}
+
+	changesYAML, err := yaml.Marshal(run.Changes)
+	if err != nil {
+		return err
+	}
+
+	errorsYAML, err := yaml.Marshal(run.Errors)
+	if err != nil {
+		return err
+	}
+
+	run.StagesYAML = sql.NullString{String: string(stagesYAML), Valid: true}
+	run.ChangesYAML = sql.NullString{String: string(changesYAML), Valid: true}
+	run.ErrorsYAML = sql.NullString{String: string(errorsYAML), Valid: true}
+	return nil
+}
+
+// FindSyncRuns returns the most recent runs of the user with the given
+// login, newest first, including runs from before they were renamed.
+func FindSyncRuns(db *DB, login string, limit int) ([]*SyncRun, error) {
+	runs := []*SyncRun{}
+	err := db.Select(&runs, `
+		SELECT *
+		FROM sync_runs
+		WHERE login = $1 OR user_id IN (SELECT id FROM users WHERE login = $1)
+		ORDER BY started_at DESC
+		LIMIT $2
+	`, login, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, run := range runs {
+		err = run.Hydrate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return runs, nil
+}
+
+func syncRunStatusOf(err error) string {
+	if err == nil {
+		return SyncRunCompleted
+	}
+	if err == errSyncInterrupted {
+		return SyncRunInterrupted
+	}
+	if _, ok := err.(*StageTimeoutError); ok {
+		return SyncRunTimedOut
+	}
+	return SyncRunErrored
+}
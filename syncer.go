@@ -1,75 +1,252 @@
 package accountsync
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
+	"runtime/debug"
 	"strings"
 	"time"
 
 	"github.com/google/go-github/github"
-	"github.com/travis-ci/encrypted-column"
-	"golang.org/x/oauth2"
+	"golang.org/x/net/context"
 
 	_ "github.com/lib/pq"
 )
 
-type tokenSource struct {
-	token *oauth2.Token
+type Syncer struct {
+	db     *DB
+	cfg    *Config
+	app    *GithubApp
+	locker *userLocker
+}
+
+var (
+	// errSyncInterrupted is returned by a stage which stopped early because
+	// the sync is shutting down.
+	errSyncInterrupted = fmt.Errorf("sync interrupted by shutdown")
+	// errSyncTimedOut is returned by a stage or GitHub request which ran
+	// past its deadline.
+	errSyncTimedOut = fmt.Errorf("sync deadline exceeded")
+)
+
+// SyncResult sums up a sync run.  Users skipped because another process
+// syncs them or their token is invalid count neither as completed nor as
+// failed.
+type SyncResult struct {
+	Users                int
+	Completed            int
+	Failed               int
+	TimedOut             int
+	Interrupted          int
+	NotStarted           int
+	Locked               int
+	InvalidTokens        int
+	SkippedInvalidTokens int
+	// EducationFailed counts the users whose education lookup failed, which
+	// does not fail their sync.
+	EducationFailed int
+	Shutdown        bool
+
+	// Errors holds the errors of each failed user by login.
+	Errors map[string][]error
 }
 
-func (ts *tokenSource) Token() (*oauth2.Token, error) {
-	return ts.token, nil
+// AllFailed reports whether users failed and none completed.
+func (result *SyncResult) AllFailed() bool {
+	return result.Failed > 0 && result.Completed == 0
 }
 
-type Syncer struct {
-	db  *DB
-	cfg *Config
+// PartiallyFailed reports whether some users failed and others completed.
+func (result *SyncResult) PartiallyFailed() bool {
+	return result.Failed > 0 && result.Completed > 0
+}
+
+type StagePanicError struct {
+	Stage string
+	Value interface{}
+}
+
+func (err *StagePanicError) Error() string {
+	return fmt.Sprintf("msg=\"sync stage panicked\" sync=%v panic=%v", err.Stage, err.Value)
+}
+
+// StageTimeoutError is recorded for a user when a stage of their sync, or
+// the sync of the user as a whole, ran out of time.
+type StageTimeoutError struct {
+	Stage   string
+	Timeout time.Duration
+	User    bool
+}
+
+func (err *StageTimeoutError) Error() string {
+	deadline := "stage"
+	if err.User {
+		deadline = "user"
+	}
+	return fmt.Sprintf("msg=\"sync stage timed out\" sync=%v deadline=%v timeout=%v",
+		err.Stage, deadline, err.Timeout)
+}
+
+func githubUserAgent() string {
+	return fmt.Sprintf("Travis CI Account Sync/%s", VersionString)
+}
+
+func newGithubClientWithTransport(cfg *Config, transport http.RoundTripper) (*github.Client, error) {
+	return newGithubClientWithTimeout(cfg, transport, 0)
+}
+
+// newGithubClientWithTimeout returns a client whose requests are canceled
+// after timeout, where a timeout of zero means none.
+func newGithubClientWithTimeout(cfg *Config, transport http.RoundTripper, timeout time.Duration) (*github.Client, error) {
+	client := github.NewClient(&http.Client{Transport: transport, Timeout: timeout})
+	client.UserAgent = githubUserAgent()
+
+	baseURL, err := parseBaseURL(cfg.GithubAPIURL)
+	if err != nil {
+		return nil, err
+	}
+	client.BaseURL = baseURL
+
+	uploadURL, err := parseBaseURL(cfg.GithubUploadURL)
+	if err != nil {
+		return nil, err
+	}
+	client.UploadURL = uploadURL
+
+	return client, nil
+}
+
+// parseBaseURL parses a URL that request paths are resolved against, which
+// needs a trailing slash to keep its own path, as on GitHub Enterprise.
+func parseBaseURL(rawurl string) (*url.URL, error) {
+	if !strings.HasSuffix(rawurl, "/") {
+		rawurl += "/"
+	}
+	return url.Parse(rawurl)
 }
 
 func NewSyncer(cfg *Config) (*Syncer, error) {
 	syncer := &Syncer{cfg: cfg}
 	log.Println("msg=\"creating database connection\"")
-	db, err := NewDB(syncer.cfg.DatabaseURL, syncer.cfg.SyncCacheSize)
+	db, err := NewDB(syncer.cfg.DatabaseURL, syncer.cfg.SyncCacheSize,
+		syncer.cfg.SyncCacheTTL, syncer.cfg.SyncCacheNegativeTTL)
 	if err != nil {
 		return nil, err
 	}
 	syncer.db = db
+
+	err = NewMigrator(db).CheckSchemaVersion()
+	if _, ok := err.(*SchemaVersionError); ok {
+		return nil, &ConfigError{Err: err}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	locker, err := newUserLocker(syncer.cfg.DatabaseURL)
+	if err != nil {
+		return nil, err
+	}
+	syncer.locker = locker
+
+	if cfg.GithubAppID != 0 {
+		log.Printf("msg=\"authenticating as GitHub App\" app_id=%v", cfg.GithubAppID)
+		app, err := NewGithubAppFromFile(cfg.GithubAppID, cfg.GithubAppPrivateKeyPath, cfg.GithubAPIURL)
+		if err != nil {
+			return nil, &ConfigError{Err: err}
+		}
+		syncer.app = app
+	}
+
 	return syncer, nil
 }
 
-func (syncer *Syncer) Sync() {
+// syncStage is one step of syncing a user.  The stages of a user run in
+// order, and a failing one skips the rest.
+type syncStage struct {
+	name    string
+	timeout time.Duration
+	sync    func(stageCtx context.Context, client *github.Client, transport http.RoundTripper) error
+}
+
+// Sync syncs all configured users.  Once runCtx is done, the page or stage
+// at hand is completed but nothing new is started.  Errors of users are
+// reported in the result, whereas a ConfigError is returned when the
+// configuration does not allow syncing anyone.
+func (syncer *Syncer) Sync(runCtx context.Context) (*SyncResult, error) {
 	log.SetFlags(log.LstdFlags)
 
 	if syncer.cfg.EncryptionKey == "" {
-		log.Fatal("msg=\"missing encryption key\"")
+		return nil, &ConfigError{Err: errMissingEncryptionKey}
 	}
 
 	userInfoSyncer := NewUserInfoSyncer(syncer.db, syncer.cfg)
 	orgSyncer := NewOrganizationSyncer(syncer.db, syncer.cfg)
-	ownerReposSyncer := NewOwnerRepositoriesSyncer(syncer.db, syncer.cfg)
+	ownerReposSyncer := NewOwnerRepositoriesSyncer(syncer.db, syncer.cfg, syncer.app)
 
-	ghTokCol, err := encryptedcolumn.NewEncryptedColumn(syncer.cfg.EncryptionKey, true)
+	ghTokCol, err := NewKeyring(syncer.cfg.EncryptionKey, syncer.cfg.OldEncryptionKeys)
 	if err != nil {
-		log.Fatal(err)
+		return nil, &ConfigError{Err: err}
+	}
+
+	if !syncer.cfg.AllStagesEnabled() {
+		log.Printf("msg=\"running selected stages only\" stages=%v", strings.Join(syncer.cfg.Stages, ","))
 	}
 
 	errMap := map[string][]error{}
+	completedMap := map[string]bool{}
+	result := &SyncResult{Errors: map[string][]error{}}
 
 	for _, githubUsername := range syncer.cfg.GithubUsernames {
 		if strings.TrimSpace(githubUsername) == "" {
 			continue
 		}
+
+		if runCtx.Err() != nil {
+			result.NotStarted++
+			continue
+		}
 		user := &User{}
 
 		errMap[githubUsername] = []error{}
+		addStageErr := func(stage string, err error) []*SyncError {
+			syncErrs := syncErrors(err, githubUsername, stage)
+			for _, syncErr := range syncErrs {
+				incrMetric("errors."+string(syncErr.Kind), 1)
+				errMap[githubUsername] = append(errMap[githubUsername], syncErr)
+			}
+			return syncErrs
+		}
 		addErr := func(err error) {
-			errMap[githubUsername] = append(errMap[githubUsername], err)
+			addStageErr("user", err)
+		}
+		stageErr := func(stage string, err error) {
+			syncErrs := addStageErr(stage, err)
+			log.Printf("state=errored sync=%v err=%v login=%v", stage, err, githubUsername)
+
+			revoked := false
+			for _, syncErr := range syncErrs {
+				revoked = revoked || syncErr.RevokesUserToken()
+			}
+			if !revoked {
+				return
+			}
+
+			log.Printf("level=warn msg=\"marking token invalid\" sync=%v login=%v", stage, githubUsername)
+			result.InvalidTokens++
+			markErr := syncer.markTokenInvalid(user)
+			if markErr != nil {
+				addErr(databaseError(markErr))
+			}
 		}
 
 		log.Printf("msg=\"fetching user\" login=%v", githubUsername)
 		err = syncer.db.Get(user, "SELECT * FROM users WHERE login = $1", githubUsername)
 		if err != nil {
-			addErr(err)
+			addErr(databaseError(err))
 			continue
 		}
 
@@ -79,64 +256,247 @@ func (syncer *Syncer) Sync() {
 			continue
 		}
 
-		token, err := ghTokCol.Load(user.GithubOauthToken.String)
+		if user.HasInvalidToken() {
+			log.Printf("msg=\"skipping user with invalid token\" login=%v invalid_at=%v",
+				githubUsername, user.GithubOauthTokenInvalidAt)
+			result.SkippedInvalidTokens++
+			continue
+		}
+
+		ts, err := newUserTokenSource(syncer.db, syncer.cfg, ghTokCol, user)
 		if err != nil {
 			addErr(err)
 			continue
 		}
 
-		ts := &tokenSource{
-			token: &oauth2.Token{
-				AccessToken: token,
-			},
+		lock, err := lockUser(syncer.db, syncer.locker, user, syncer.cfg.UserLockTimeout)
+		if err == errUserLocked {
+			log.Printf("msg=\"skipping user synced by another process\" login=%v", githubUsername)
+			result.Locked++
+			continue
+		}
+		if err != nil {
+			addErr(databaseError(err))
+			continue
 		}
-
-		tc := oauth2.NewClient(oauth2.NoContext, ts)
-		client := github.NewClient(tc)
-		client.UserAgent = fmt.Sprintf("Travis CI Account Sync/%s", VersionString)
 
 		fullStarted := time.Now().UTC()
 		log.Printf("state=started sync=user login=%v", githubUsername)
 
-		started := time.Now().UTC()
-		log.Printf("state=started sync=user_info login=%v", githubUsername)
-		err = userInfoSyncer.Sync(user, client)
+		run := newSyncRun(user)
+		err = run.Start(syncer.db)
 		if err != nil {
-			addErr(err)
-			log.Printf("state=errored sync=user_info err=%v login=%v", err, githubUsername)
-			continue
+			log.Printf("level=warn msg=\"recording sync run failed\" login=%v err=%v", githubUsername, err)
+		}
+
+		allStages := []syncStage{
+			{"user_info", syncer.cfg.UserInfoTimeout, func(stageCtx context.Context, client *github.Client, transport http.RoundTripper) error {
+				return userInfoSyncer.Sync(stageCtx, user, client, transport)
+			}},
+			{"organizations", syncer.cfg.OrganizationsTimeout, func(stageCtx context.Context, client *github.Client, transport http.RoundTripper) error {
+				return orgSyncer.Sync(stageCtx, user, client)
+			}},
+			{"repositories", syncer.cfg.RepositoriesTimeout, func(stageCtx context.Context, client *github.Client, transport http.RoundTripper) error {
+				return ownerReposSyncer.Sync(stageCtx, user, client)
+			}},
+		}
+
+		stages := []syncStage{}
+		for _, stage := range allStages {
+			if syncer.cfg.StageEnabled(stage.name) {
+				stages = append(stages, stage)
+			}
+		}
+
+		userCtx, cancelUser := withOptionalTimeout(withSyncRun(runCtx, run), syncer.cfg.UserTimeout)
+		transport := newScopesTransport(syncer.db, user, ts.Transport())
+
+		completed := true
+		for i, stage := range stages {
+			stageStarted := time.Now().UTC()
+			err = lock.Check()
+			if err == nil {
+				err = syncer.runStage(userCtx, stage, githubUsername, transport)
+			}
+			run.AddStage(stage.name, stageStarted, err)
+			if err == nil {
+				continue
+			}
+
+			for _, skipped := range stages[i+1:] {
+				run.SkipStage(skipped.name)
+			}
+
+			completed = false
+			if err == errSyncInterrupted {
+				log.Printf("state=interrupted sync=%v login=%v", stage.name, githubUsername)
+				result.Interrupted++
+			} else {
+				if _, ok := err.(*StageTimeoutError); ok {
+					result.TimedOut++
+				}
+				stageErr(stage.name, err)
+			}
+			break
+		}
+		cancelUser()
+
+		if completed && syncer.cfg.AllStagesEnabled() {
+			err = lock.Check()
+			if err == nil {
+				err = syncer.markSynced(user)
+			}
+			if err != nil {
+				addErr(databaseError(err))
+			}
+		}
+
+		if run.EducationFailed {
+			result.EducationFailed++
 		}
-		log.Printf("state=completed sync=user_info login=%v duration=%v",
-			githubUsername, time.Now().UTC().Sub(started))
 
-		started = time.Now().UTC()
-		log.Printf("state=started sync=organizations login=%v", githubUsername)
-		err = orgSyncer.Sync(user, client)
+		err = run.Finish(syncer.db, errMap[githubUsername])
 		if err != nil {
-			addErr(err)
-			log.Printf("state=errored sync=organizations err=%v login=%v", err, githubUsername)
-			continue
+			log.Printf("level=warn msg=\"recording sync run failed\" login=%v err=%v", githubUsername, err)
 		}
-		log.Printf("state=completed sync=organizations login=%v duration=%v",
-			githubUsername, time.Now().UTC().Sub(started))
 
-		started = time.Now().UTC()
-		log.Printf("state=started sync=repositories login=%v", githubUsername)
-		err = ownerReposSyncer.Sync(user, client)
+		err = lock.Release()
 		if err != nil {
-			addErr(err)
-			continue
+			addErr(databaseError(err))
 		}
-		log.Printf("state=completed sync=repositories login=%v duration=%v",
-			githubUsername, time.Now().UTC().Sub(started))
 
-		log.Printf("state=completed sync=user login=%v duration=%v",
-			githubUsername, time.Now().UTC().Sub(fullStarted))
+		// marking the user synced or releasing the lock may still have failed
+		if completed && len(errMap[githubUsername]) == 0 {
+			completedMap[githubUsername] = true
+			log.Printf("state=completed sync=user login=%v duration=%v",
+				githubUsername, time.Now().UTC().Sub(fullStarted))
+		}
 	}
 
-	for githubUsername, errors := range errMap {
+	syncer.db.LogCacheStats()
+
+	result.Shutdown = runCtx.Err() != nil
+	tallyUsers(result, errMap, completedMap)
+
+	log.Printf("msg=\"sync run finished\" users=%v completed=%v failed=%v timed_out=%v interrupted=%v "+
+		"not_started=%v locked=%v invalid_tokens=%v skipped_invalid_tokens=%v education_failed=%v shutdown=%v",
+		result.Users, result.Completed, result.Failed, result.TimedOut, result.Interrupted,
+		result.NotStarted, result.Locked, result.InvalidTokens, result.SkippedInvalidTokens,
+		result.EducationFailed, result.Shutdown)
+	incrMetric("users.failed", result.Failed)
+	incrMetric("users.locked", result.Locked)
+	incrMetric("users.timed_out", result.TimedOut)
+	incrMetric("users.invalid_tokens", result.InvalidTokens)
+	incrMetric("users.skipped_invalid_tokens", result.SkippedInvalidTokens)
+
+	for githubUsername, errors := range result.Errors {
 		for _, err := range errors {
 			log.Printf("level=error login=%s err=%q", githubUsername, err.Error())
 		}
 	}
+
+	log.Printf("state=completed sync=run %s", metricsLogfmt())
+
+	return result, nil
+}
+
+// tallyUsers counts each user that was synced once in the result, as either
+// failed or completed, or as neither when their sync was interrupted.
+func tallyUsers(result *SyncResult, errMap map[string][]error, completedMap map[string]bool) {
+	result.Users = len(errMap)
+	for githubUsername, errors := range errMap {
+		if len(errors) > 0 {
+			result.Failed++
+			result.Errors[githubUsername] = errors
+		} else if completedMap[githubUsername] {
+			result.Completed++
+		}
+	}
+}
+
+// runStage runs one stage of a user's sync with a client whose requests are
+// aborted once the stage or user deadline passes.  A panic is turned into
+// an error of that user, so that the remaining users are still synced.
+func (syncer *Syncer) runStage(userCtx context.Context, stage syncStage, login string, transport http.RoundTripper) (err error) {
+	err = contextErr(userCtx)
+	if err == errSyncTimedOut {
+		return &StageTimeoutError{Stage: stage.name, Timeout: syncer.cfg.UserTimeout, User: true}
+	}
+	if err != nil {
+		return err
+	}
+
+	stageCtx, cancel := withOptionalTimeout(userCtx, stage.timeout)
+	defer cancel()
+
+	stageTransport := &deadlineTransport{ctx: stageCtx, base: transport}
+	client, err := newGithubClientWithTransport(syncer.cfg, stageTransport)
+	if err != nil {
+		return err
+	}
+
+	started := time.Now().UTC()
+	log.Printf("state=started sync=%v login=%v", stage.name, login)
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("level=error msg=\"recovered panic\" sync=%v login=%v panic=%v stack=%q",
+				stage.name, login, r, debug.Stack())
+			incrMetric("users.panics", 1)
+			err = &StagePanicError{Stage: stage.name, Value: r}
+			return
+		}
+
+		if err == nil || stageCtx.Err() != context.DeadlineExceeded {
+			return
+		}
+
+		// whatever failed first, the stage ran out of time
+		log.Printf("level=debug msg=\"stage error after deadline\" sync=%v login=%v err=%v",
+			stage.name, login, err)
+		if userCtx.Err() == context.DeadlineExceeded {
+			err = &StageTimeoutError{Stage: stage.name, Timeout: syncer.cfg.UserTimeout, User: true}
+		} else {
+			err = &StageTimeoutError{Stage: stage.name, Timeout: stage.timeout}
+		}
+	}()
+
+	err = stage.sync(stageCtx, client, stageTransport)
+	if err == nil {
+		log.Printf("state=completed sync=%v login=%v duration=%v",
+			stage.name, login, time.Now().UTC().Sub(started))
+	}
+	return err
+}
+
+// markSynced records when the user was last synced completely, which is when
+// they are due again.
+func (syncer *Syncer) markSynced(user *User) error {
+	now := time.Now().UTC()
+	_, err := syncer.db.Exec(`UPDATE users SET synced_at = $1 WHERE id = $2`, now, user.ID)
+	if err != nil {
+		return err
+	}
+
+	user.SyncedAt = &now
+	return nil
+}
+
+// markTokenInvalid records that GitHub rejected the user's current token, so
+// that the user is not synced again until they log in and get a new one.  A
+// digest of the encrypted token is stored, not the token itself.
+func (syncer *Syncer) markTokenInvalid(user *User) error {
+	now := time.Now().UTC()
+	_, err := syncer.db.Exec(`
+		UPDATE users
+		SET github_oauth_token_invalid_digest = md5(github_oauth_token), github_oauth_token_invalid_at = $1
+		WHERE id = $2`, now, user.ID)
+	if err != nil {
+		return err
+	}
+
+	user.GithubOauthTokenInvalidDigest = sql.NullString{String: tokenDigest(user.GithubOauthToken.String), Valid: true}
+	user.GithubOauthTokenInvalidAt = &now
+	syncer.db.InvalidateUser(int(user.GithubID.Int64))
+	return nil
 }
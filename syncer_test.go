@@ -0,0 +1,36 @@
+package accountsync
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTallyUsers(t *testing.T) {
+	errMap := map[string][]error{
+		"completed":           {},
+		"failed":              {fmt.Errorf("stage failed")},
+		"interrupted":         {},
+		"mark synced failed":  {fmt.Errorf("mark synced failed")},
+		"lock release failed": {fmt.Errorf("release failed")},
+	}
+	// users whose stages all passed, before marking them synced and
+	// releasing their lock had failed
+	completedMap := map[string]bool{
+		"completed":           true,
+		"mark synced failed":  true,
+		"lock release failed": true,
+	}
+
+	result := &SyncResult{Errors: map[string][]error{}}
+	tallyUsers(result, errMap, completedMap)
+
+	if result.Users != 5 || result.Completed != 1 || result.Failed != 3 {
+		t.Errorf("expected 5 users, 1 completed and 3 failed, got %+v", result)
+	}
+	if len(result.Errors) != 3 {
+		t.Errorf("expected errors of 3 users, got %v", result.Errors)
+	}
+	if !result.PartiallyFailed() {
+		t.Error("expected the run to have partially failed")
+	}
+}
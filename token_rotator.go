@@ -0,0 +1,150 @@
+package accountsync
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+type TokenRotationStats struct {
+	Rotated int
+	Skipped int
+	Failed  int
+	LastID  int64
+}
+
+// TokenRotator re-encrypts the users' tokens with the primary key of a
+// keyring, in batches which are ordered by user ID so that an interrupted
+// rotation can be resumed from the last ID it reported.
+type TokenRotator struct {
+	db        *DB
+	keyring   *Keyring
+	batchSize int
+}
+
+type tokenRotationRow struct {
+	ID           int64          `db:"id"`
+	Token        sql.NullString `db:"github_oauth_token"`
+	RefreshToken sql.NullString `db:"github_refresh_token"`
+}
+
+func NewTokenRotator(db *DB, keyring *Keyring, batchSize int) *TokenRotator {
+	return &TokenRotator{db: db, keyring: keyring, batchSize: batchSize}
+}
+
+func (tr *TokenRotator) Rotate(startID int64) (*TokenRotationStats, error) {
+	stats := &TokenRotationStats{LastID: startID}
+
+	var total int
+	err := tr.db.Get(&total, `SELECT COUNT(*) FROM users WHERE id > $1`, startID)
+	if err != nil {
+		return stats, err
+	}
+
+	started := time.Now().UTC()
+	log.Printf("state=started rotate=tokens start_id=%v total=%v", startID, total)
+
+	for {
+		rows := []*tokenRotationRow{}
+		err = tr.db.Select(&rows, `
+			SELECT id, github_oauth_token, github_refresh_token
+			FROM users
+			WHERE id > $1
+			ORDER BY id
+			LIMIT $2`, stats.LastID, tr.batchSize)
+		if err != nil {
+			return stats, err
+		}
+
+		if len(rows) == 0 {
+			break
+		}
+
+		for _, row := range rows {
+			rotated, err := tr.rotateRow(row)
+			switch {
+			case err != nil:
+				stats.Failed++
+				log.Printf("level=error rotate=tokens user_id=%v err=%v", row.ID, err)
+			case rotated:
+				stats.Rotated++
+			default:
+				stats.Skipped++
+			}
+			stats.LastID = row.ID
+		}
+
+		done := stats.Rotated + stats.Skipped + stats.Failed
+		log.Printf("state=progress rotate=tokens last_id=%v rotated=%v skipped=%v failed=%v done=%v total=%v",
+			stats.LastID, stats.Rotated, stats.Skipped, stats.Failed, done, total)
+	}
+
+	log.Printf("state=completed rotate=tokens last_id=%v rotated=%v skipped=%v failed=%v duration=%v",
+		stats.LastID, stats.Rotated, stats.Skipped, stats.Failed, time.Now().UTC().Sub(started))
+	return stats, nil
+}
+
+// rotateRow re-encrypts the tokens of one user unless they are encrypted
+// with the primary key already.  The update only applies if the tokens have
+// not been changed meanwhile, e.g. by a sync refreshing them.
+func (tr *TokenRotator) rotateRow(row *tokenRotationRow) (bool, error) {
+	token, rotateToken, err := tr.reencrypt(row.Token)
+	if err != nil {
+		return false, err
+	}
+
+	refreshToken, rotateRefreshToken, err := tr.reencrypt(row.RefreshToken)
+	if err != nil {
+		return false, err
+	}
+
+	if !rotateToken && !rotateRefreshToken {
+		return false, nil
+	}
+
+	// keep marking an invalid token as such, which refers to the token as
+	// it was encrypted before
+	res, err := tr.db.Exec(`
+		UPDATE users
+		SET github_oauth_token = $1, github_refresh_token = $2,
+		    github_oauth_token_invalid_digest = CASE
+		      WHEN github_oauth_token_invalid_digest = md5(github_oauth_token) THEN md5($1)
+		      ELSE github_oauth_token_invalid_digest
+		    END
+		WHERE id = $3
+		  AND github_oauth_token IS NOT DISTINCT FROM $4
+		  AND github_refresh_token IS NOT DISTINCT FROM $5`,
+		token, refreshToken, row.ID, row.Token, row.RefreshToken)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+func (tr *TokenRotator) reencrypt(value sql.NullString) (sql.NullString, bool, error) {
+	if !value.Valid || value.String == "" {
+		return value, false, nil
+	}
+
+	plain, keyIndex, err := tr.keyring.LoadWithKeyIndex(value.String)
+	if err != nil {
+		return value, false, err
+	}
+
+	if keyIndex == 0 {
+		return value, false, nil
+	}
+
+	encrypted, err := tr.keyring.Dump(plain)
+	if err != nil {
+		return value, false, err
+	}
+
+	return sql.NullString{String: encrypted, Valid: true}, true, nil
+}
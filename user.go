@@ -1,8 +1,11 @@
 package accountsync
 
 import (
+	"crypto/md5"
 	"database/sql"
 	"fmt"
+	"log"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -15,20 +18,26 @@ var (
 type User struct {
 	ID sql.NullInt64 `db:"id"`
 
-	CreatedAt        *time.Time     `db:"created_at"`
-	Education        sql.NullBool   `db:"education"`
-	Email            sql.NullString `db:"email"`
-	GithubID         sql.NullInt64  `db:"github_id"`
-	GithubOauthToken sql.NullString `db:"github_oauth_token"`
-	GithubScopesYAML sql.NullString `db:"github_scopes"`
-	GravatarID       sql.NullString `db:"gravatar_id"`
-	IsAdmin          sql.NullBool   `db:"is_admin"`
-	IsSyncing        sql.NullBool   `db:"is_syncing"`
-	Locale           sql.NullString `db:"locale"`
-	Login            sql.NullString `db:"login"`
-	Name             sql.NullString `db:"name"`
-	SyncedAt         *time.Time     `db:"synced_at"`
-	UpdatedAt        *time.Time     `db:"updated_at"`
+	CreatedAt                     *time.Time     `db:"created_at"`
+	Education                     sql.NullBool   `db:"education"`
+	Email                         sql.NullString `db:"email"`
+	GithubID                      sql.NullInt64  `db:"github_id"`
+	GithubOauthToken              sql.NullString `db:"github_oauth_token"`
+	GithubOauthTokenExpiresAt     *time.Time     `db:"github_oauth_token_expires_at"`
+	GithubOauthTokenInvalidDigest sql.NullString `db:"github_oauth_token_invalid_digest"`
+	GithubOauthTokenInvalidAt     *time.Time     `db:"github_oauth_token_invalid_at"`
+	GithubRefreshToken            sql.NullString `db:"github_refresh_token"`
+	GithubRefreshTokenExpiresAt   *time.Time     `db:"github_refresh_token_expires_at"`
+	GithubScopesYAML              sql.NullString `db:"github_scopes"`
+	GravatarID                    sql.NullString `db:"gravatar_id"`
+	IsAdmin                       sql.NullBool   `db:"is_admin"`
+	IsSyncing                     sql.NullBool   `db:"is_syncing"`
+	Locale                        sql.NullString `db:"locale"`
+	Login                         sql.NullString `db:"login"`
+	Name                          sql.NullString `db:"name"`
+	RepositoriesSyncedAt          *time.Time     `db:"repositories_synced_at"`
+	SyncedAt                      *time.Time     `db:"synced_at"`
+	UpdatedAt                     *time.Time     `db:"updated_at"`
 
 	GithubScopes  []string
 	Organizations []*Organization
@@ -48,6 +57,73 @@ func (user *User) Hydrate() error {
 	return yaml.Unmarshal([]byte(user.GithubScopesYAML.String), &user.GithubScopes)
 }
 
+// HasInvalidToken reports whether GitHub rejected the user's current token.
+// Logging in again replaces the token, which clears this.
+func (user *User) HasInvalidToken() bool {
+	return user.GithubOauthTokenInvalidDigest.Valid &&
+		user.GithubOauthTokenInvalidDigest.String == tokenDigest(user.GithubOauthToken.String)
+}
+
+// tokenDigest identifies an encrypted token, the way the md5() of the
+// database does, so that a rejected token is recognized without keeping a
+// copy of it.
+func tokenDigest(encrypted string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(encrypted)))
+}
+
+// CanListPrivateOrgs reports whether the user's token lists the orgs the
+// user is a private member of too.  Without one of the org scopes, GitHub
+// only lists public memberships.
+func (user *User) CanListPrivateOrgs() bool {
+	for _, scope := range []string{"read:org", "write:org", "admin:org"} {
+		if sliceContains(user.GithubScopes, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScopesDiffer reports whether scopes is a different set of scopes than the
+// ones stored for the user.
+func (user *User) ScopesDiffer(scopes []string) bool {
+	if len(scopes) != len(user.GithubScopes) {
+		return true
+	}
+
+	for _, scope := range scopes {
+		if !sliceContains(user.GithubScopes, scope) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UpdateScopes stores scopes as the ones the user's token has, unless they
+// are stored already.
+func (user *User) UpdateScopes(db *DB, scopes []string) error {
+	if !user.ScopesDiffer(scopes) {
+		return nil
+	}
+
+	scopesYAML, err := dumpGithubScopes(scopes)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("msg=\"updating scopes\" login=%v old_scopes=%v scopes=%v",
+		user.Login.String, user.GithubScopes, scopes)
+	_, err = db.Exec(`UPDATE users SET github_scopes = $1 WHERE id = $2`, scopesYAML, user.ID)
+	if err != nil {
+		return err
+	}
+
+	user.GithubScopes = scopes
+	user.GithubScopesYAML = sql.NullString{String: scopesYAML, Valid: true}
+	db.InvalidateUser(int(user.GithubID.Int64))
+	return nil
+}
+
 func (user *User) HydrateOrganizations(db *DB) error {
 	if user.Organizations != nil {
 		return nil
@@ -63,3 +139,26 @@ func (user *User) HydrateOrganizations(db *DB) error {
 			WHERE user_id = $1
 		)`, user.ID)
 }
+
+// parseGithubScopes parses the comma separated scopes GitHub sends in the
+// X-OAuth-Scopes header.
+func parseGithubScopes(header string) []string {
+	scopes := []string{}
+	for _, scope := range strings.Split(header, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// dumpGithubScopes serializes scopes the way they are stored in
+// github_scopes, which is as a YAML document.
+func dumpGithubScopes(scopes []string) (string, error) {
+	b, err := yaml.Marshal(scopes)
+	if err != nil {
+		return "", err
+	}
+	return "---\n" + string(b), nil
+}
@@ -1,12 +1,19 @@
 package accountsync
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
+	"net/http"
 	"time"
 
 	"github.com/google/go-github/github"
 	"github.com/jmoiron/sqlx"
+	"golang.org/x/net/context"
+)
+
+var (
+	errEducationTimeout = fmt.Errorf("education lookup timed out")
 )
 
 type UserSyncError struct {
@@ -23,9 +30,12 @@ func (err *UserSyncError) Error() string {
 }
 
 type userInfoSyncContext struct {
+	runCtx context.Context
+
 	user           *User
 	ghUser         *github.User
 	client         *github.Client
+	transport      http.RoundTripper
 	allEmails      []github.UserEmail
 	verifiedEmails []string
 	currentEmails  []string
@@ -34,16 +44,27 @@ type userInfoSyncContext struct {
 type UserInfoSyncer struct {
 	db  *DB
 	cfg *Config
+
+	educationBreaker *circuitBreaker
 }
 
 func NewUserInfoSyncer(db *DB, cfg *Config) *UserInfoSyncer {
-	return &UserInfoSyncer{db: db, cfg: cfg}
+	return &UserInfoSyncer{
+		db:  db,
+		cfg: cfg,
+
+		educationBreaker: newCircuitBreaker(cfg.EducationBreakerThreshold, cfg.EducationBreakerCooldown),
+	}
 }
 
-func (uis *UserInfoSyncer) Sync(user *User, client *github.Client) error {
+// Sync updates the user's info and emails.  Transport is the one of client,
+// which the education lookup uses with its own timeout.
+func (uis *UserInfoSyncer) Sync(runCtx context.Context, user *User, client *github.Client, transport http.RoundTripper) error {
 	ctx := &userInfoSyncContext{
+		runCtx:         runCtx,
 		user:           user,
 		client:         client,
+		transport:      transport,
 		allEmails:      []github.UserEmail{},
 		verifiedEmails: []string{},
 		currentEmails:  []string{},
@@ -54,6 +75,11 @@ func (uis *UserInfoSyncer) Sync(user *User, client *github.Client) error {
 		return err
 	}
 
+	err = checkGithubUser(ghUser)
+	if err != nil {
+		return err
+	}
+
 	ctx.ghUser = ghUser
 
 	syncErr := &UserSyncError{
@@ -76,10 +102,7 @@ func (uis *UserInfoSyncer) Sync(user *User, client *github.Client) error {
 		return err
 	}
 
-	edu, err := uis.getIsEducation(ctx)
-	if err != nil {
-		return err
-	}
+	edu := uis.getIsEducation(ctx)
 
 	isEdu := user.Education.Bool
 	if edu != nil {
@@ -91,19 +114,26 @@ func (uis *UserInfoSyncer) Sync(user *User, client *github.Client) error {
 		return err
 	}
 
-	log.Printf("msg=\"updating user info\" sync=user_info login=%v", user.Login.String)
-	_, err = tx.Exec(`
-		UPDATE users
-		SET name = $1, login = $2, gravatar_id = $3, email = $4, education = $5,
-		    updated_at = $6
-		WHERE id = $7
-	`, *ghUser.Name, *ghUser.Login, *ghUser.GravatarID, email, isEdu,
-		time.Now().UTC(),
-		user.ID)
+	if uis.userInfoChanged(user, ghUser, email, isEdu) {
+		log.Printf("msg=\"updating user info\" sync=user_info login=%v", user.Login.String)
+		_, err = tx.Exec(`
+			UPDATE users
+			SET name = $1, login = $2, gravatar_id = $3, email = $4, education = $5,
+			    updated_at = $6
+			WHERE id = $7
+		`, strPtrOrEmpty(ghUser.Name), *ghUser.Login, strPtrOrEmpty(ghUser.GravatarID), email, isEdu,
+			time.Now().UTC(),
+			user.ID)
 
-	if err != nil {
-		tx.Rollback()
-		return err
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		uis.db.InvalidateUser(*ghUser.ID)
+		countChange(ctx.runCtx, "users.updated", 1)
+	} else {
+		log.Printf("msg=\"user info unchanged\" action=unchanged sync=user_info login=%v", user.Login.String)
+		countChange(ctx.runCtx, "users.unchanged", 1)
 	}
 
 	log.Printf("msg=\"updating emails\" sync=user_info login=%v", user.Login.String)
@@ -117,68 +147,80 @@ func (uis *UserInfoSyncer) Sync(user *User, client *github.Client) error {
 	return tx.Commit()
 }
 
+func (uis *UserInfoSyncer) userInfoChanged(user *User, ghUser *github.User, email string, isEdu bool) bool {
+	return user.Name != sql.NullString{String: strPtrOrEmpty(ghUser.Name), Valid: true} ||
+		user.Login != sql.NullString{String: strPtrOrEmpty(ghUser.Login), Valid: true} ||
+		user.GravatarID != sql.NullString{String: strPtrOrEmpty(ghUser.GravatarID), Valid: true} ||
+		user.Email != sql.NullString{String: email, Valid: true} ||
+		user.Education != sql.NullBool{Bool: isEdu, Valid: true}
+}
+
 func (uis *UserInfoSyncer) getUserEmail(ctx *userInfoSyncContext) (string, error) {
 	log.Printf("msg=\"fetching all emails\" level=debug sync=user_info login=%s",
 		ctx.user.Login.String)
 
 	allEmails, err := uis.getAllGithubEmails(ctx)
 	if err != nil {
-		return *ctx.ghUser.Email, err
+		return strPtrOrEmpty(ctx.ghUser.Email), err
 	}
 
 	ctx.allEmails = allEmails
 
 	currentEmails, err := uis.getCurrentlySyncedEmails(ctx)
 	if err != nil {
-		return *ctx.ghUser.Email, err
+		return strPtrOrEmpty(ctx.ghUser.Email), err
 	}
 
 	ctx.currentEmails = currentEmails
 
+	email, verifiedEmails := chooseGithubEmail(ctx.ghUser.Email, allEmails, ctx.user.Email.String)
+	ctx.verifiedEmails = append(ctx.verifiedEmails, verifiedEmails...)
+
+	log.Printf("level=debug sync=user_info login=%s current_emails=%v",
+		ctx.user.Login.String, ctx.currentEmails)
+
+	log.Printf("level=debug sync=user_info login=%s verified_emails=%v",
+		ctx.user.Login.String, ctx.verifiedEmails)
+
+	return email, nil
+}
+
+// chooseGithubEmail picks the email of a user, which is the public email of
+// their profile, or else their primary, first verified, stored or first
+// email, in that order.  The verified emails are returned as well.
+func chooseGithubEmail(profileEmail *string, allEmails []github.UserEmail, storedEmail string) (string, []string) {
+	verifiedEmails := []string{}
 	primaryEmail := ""
 	firstEmail := ""
 	verifiedEmail := ""
-	for i, email := range allEmails {
-		if i == 0 {
+	for _, email := range allEmails {
+		if email.Email == nil || *email.Email == "" {
+			continue
+		}
+
+		if firstEmail == "" {
 			firstEmail = *email.Email
 		}
 
-		if email.Verified != nil && *email.Verified {
-			ctx.verifiedEmails = append(ctx.verifiedEmails, *email.Email)
+		if boolPtrOrFalse(email.Verified) {
+			verifiedEmails = append(verifiedEmails, *email.Email)
 			if verifiedEmail == "" {
 				verifiedEmail = *email.Email
 			}
 		}
 
-		if primaryEmail == "" && email.Primary != nil && *email.Primary {
+		if primaryEmail == "" && boolPtrOrFalse(email.Primary) {
 			primaryEmail = *email.Email
 		}
 	}
 
-	log.Printf("level=debug sync=user_info login=%s current_emails=%v",
-		ctx.user.Login.String, ctx.currentEmails)
-
-	log.Printf("level=debug sync=user_info login=%s verified_emails=%v",
-		ctx.user.Login.String, ctx.verifiedEmails)
-
-	email := *ctx.ghUser.Email
-	if email != "" {
-		return email, nil
-	}
-
-	if primaryEmail != "" {
-		return primaryEmail, nil
-	}
-
-	if verifiedEmail != "" {
-		return verifiedEmail, nil
-	}
-
-	if ctx.user.Email.String != "" {
-		return ctx.user.Email.String, nil
+	for _, email := range []string{strPtrOrEmpty(profileEmail), primaryEmail, verifiedEmail, storedEmail} {
+		if email != "" {
+			return email, verifiedEmails
+		}
 	}
 
-	return firstEmail, nil
+	return firstEmail, verifiedEmails
 }
 
 func (uis *UserInfoSyncer) getAllGithubEmails(ctx *userInfoSyncContext) ([]github.UserEmail, error) {
@@ -203,32 +245,88 @@ func (uis *UserInfoSyncer) getCurrentlySyncedEmails(ctx *userInfoSyncContext) ([
 	return emails, nil
 }
 
-func (uis *UserInfoSyncer) getIsEducation(ctx *userInfoSyncContext) (*bool, error) {
-	req, err := ctx.client.NewRequest("GET", "https://education.github.com/api/user", nil)
+// getIsEducation looks up whether the user is a student.  The lookup is
+// best effort: when it is switched off, fails or times out, nil is returned
+// and the stored value is kept.
+func (uis *UserInfoSyncer) getIsEducation(ctx *userInfoSyncContext) *bool {
+	if !uis.cfg.EducationEnabled() {
+		return nil
+	}
+
+	if !uis.educationBreaker.Allow() {
+		log.Printf("level=warn msg=\"skipping education lookup, circuit open\" sync=user_info login=%v",
+			ctx.user.Login.String)
+		incrMetric("education.skipped", 1)
+		return nil
+	}
+
+	student, err := uis.fetchIsEducation(ctx)
 	if err != nil {
-		return nil, err
+		uis.educationBreaker.Failure()
+		log.Printf("level=warn msg=\"education lookup failed, keeping stored value\" sync=user_info login=%v err=%v",
+			ctx.user.Login.String, err)
+		incrMetric("education.failed", 1)
+
+		if run := syncRunFromContext(ctx.runCtx); run != nil {
+			syncErr := &SyncError{Kind: classifyError(err), Login: ctx.user.Login.String, Stage: "user_info", Err: err}
+			run.AddNonFatalError(syncErr)
+			run.EducationFailed = true
+		}
+		return nil
 	}
 
-	body := map[string]bool{"student": false}
+	uis.educationBreaker.Success()
+	return &student
+}
 
-	_, err = ctx.client.Do(req, &body)
+// fetchIsEducation makes the lookup with a client which cancels it after
+// the education timeout, where a timeout of zero means none.
+func (uis *UserInfoSyncer) fetchIsEducation(ctx *userInfoSyncContext) (bool, error) {
+	client, err := newGithubClientWithTimeout(uis.cfg, ctx.transport, uis.cfg.EducationTimeout)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	student := body["student"]
+	req, err := client.NewRequest("GET", uis.cfg.EducationURL, nil)
+	if err != nil {
+		return false, err
+	}
 
-	return &student, nil
+	body := map[string]bool{"student": false}
+	_, err = client.Do(req, &body)
+	if isTimeout(err) {
+		return false, errEducationTimeout
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return body["student"], nil
 }
 
-func (uis *UserInfoSyncer) updateEmails(tx *sqlx.Tx, ctx *userInfoSyncContext) error {
-	diffEmails := []string{}
+// emailChanges returns the stored emails which are no longer verified on
+// GitHub, and the verified ones which are not stored yet.
+func (uis *UserInfoSyncer) emailChanges(ctx *userInfoSyncContext) ([]string, []string) {
+	removed := []string{}
 	for _, email := range ctx.currentEmails {
 		if !sliceContains(ctx.verifiedEmails, email) {
-			diffEmails = append(diffEmails, email)
+			removed = append(removed, email)
 		}
 	}
 
+	added := []string{}
+	for _, email := range ctx.verifiedEmails {
+		if !sliceContains(ctx.currentEmails, email) {
+			added = append(added, email)
+		}
+	}
+
+	return removed, added
+}
+
+func (uis *UserInfoSyncer) updateEmails(tx *sqlx.Tx, ctx *userInfoSyncContext) error {
+	diffEmails, addedEmails := uis.emailChanges(ctx)
+
 	if len(diffEmails) > 0 {
 		query, args, err := sqlx.In(`
 		DELETE FROM emails WHERE user_id = ? AND email IN (?)
@@ -243,16 +341,12 @@ func (uis *UserInfoSyncer) updateEmails(tx *sqlx.Tx, ctx *userInfoSyncContext) e
 		if err != nil {
 			return err
 		}
+		countChange(ctx.runCtx, "emails.removed", len(diffEmails))
 	} else {
 		log.Printf("msg=\"no emails to delete\" sync=user_info login=%s", ctx.user.Login.String)
 	}
 
-	diffEmails = []string{}
-	for _, email := range ctx.verifiedEmails {
-		if !sliceContains(ctx.currentEmails, email) {
-			diffEmails = append(diffEmails, email)
-		}
-	}
+	diffEmails = addedEmails
 
 	if len(diffEmails) == 0 {
 		log.Printf("msg=\"no emails to add\" sync=user_info login=%s", ctx.user.Login.String)
@@ -275,5 +369,6 @@ func (uis *UserInfoSyncer) updateEmails(tx *sqlx.Tx, ctx *userInfoSyncContext) e
 		}
 	}
 
+	countChange(ctx.runCtx, "emails.added", len(diffEmails))
 	return nil
 }
@@ -0,0 +1,67 @@
+package accountsync
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestEducationLookupFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		kind    ErrorKind
+	}{
+		{
+			name: "timeout",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				time.Sleep(200 * time.Millisecond)
+				w.Write([]byte(`{"student":true}`))
+			},
+			kind: ErrorTimeout,
+		},
+		{
+			name: "server error",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(http.StatusBadGateway)
+			},
+			kind: ErrorOther,
+		},
+	} {
+		server := httptest.NewServer(tc.handler)
+
+		cfg := &Config{
+			GithubAPIURL:     "https://api.github.com/",
+			GithubUploadURL:  "https://uploads.github.com/",
+			EducationURL:     server.URL,
+			EducationTimeout: 20 * time.Millisecond,
+		}
+		uis := &UserInfoSyncer{cfg: cfg, educationBreaker: newCircuitBreaker(0, 0)}
+
+		user := &User{Login: sql.NullString{String: "student", Valid: true}}
+		run := newSyncRun(user)
+		ctx := &userInfoSyncContext{
+			runCtx:    withSyncRun(context.Background(), run),
+			user:      user,
+			transport: &http.Transport{},
+		}
+
+		edu := uis.getIsEducation(ctx)
+		server.Close()
+
+		if edu != nil {
+			t.Errorf("%s: expected the stored value to be kept, got %v", tc.name, *edu)
+		}
+		if !run.EducationFailed {
+			t.Errorf("%s: expected the failure to be recorded in the sync run", tc.name)
+		}
+		if len(run.Errors) != 1 || !strings.Contains(run.Errors[0], "kind="+string(tc.kind)) {
+			t.Errorf("%s: expected a %v error in the sync run, got %v", tc.name, tc.kind, run.Errors)
+		}
+	}
+}
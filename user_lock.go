@@ -0,0 +1,160 @@
+package accountsync
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const (
+	// userSyncLockNamespace is the first key of the advisory locks taken on
+	// users, so that they don't clash with locks on other IDs.
+	userSyncLockNamespace = 0x61637379
+
+	pqLockNotAvailable = pq.ErrorCode("55P03")
+)
+
+var (
+	errUserLocked   = fmt.Errorf("user is being synced by another process")
+	errUserLockLost = fmt.Errorf("the sync lock of the user was lost")
+)
+
+// userLocker takes the sync locks of users on a connection of its own.  The
+// locks are session level advisory locks, so no transaction stays open
+// while a user is synced, and they go away with the connection should the
+// process die.  The pool is limited to the one connection, so that locks
+// are released on the session that took them.
+type userLocker struct {
+	db *sqlx.DB
+}
+
+func newUserLocker(databaseURL string) (*userLocker, error) {
+	db, err := sqlx.Connect("postgres", databaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	return &userLocker{db: db}, nil
+}
+
+func (locker *userLocker) Close() error {
+	return locker.db.Close()
+}
+
+// userLock is held for the whole sync of a user, so that no two processes
+// sync the same user at once.  The is_syncing column marks users being
+// synced, but only the lock is authoritative.
+type userLock struct {
+	db     *DB
+	locker *userLocker
+	user   *User
+	// pid is the backend holding the lock, which differs from the one of
+	// the locker's connection once that has been reconnected.
+	pid int
+}
+
+// lockUser takes the sync lock of user, or fails with errUserLocked when
+// another process holds it.  With a wait above zero it waits that long for
+// the lock to become free.
+func lockUser(db *DB, locker *userLocker, user *User, wait time.Duration) (*userLock, error) {
+	// the transaction only scopes the lock_timeout, the lock outlives it
+	tx, err := locker.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+
+	locked := false
+	if wait > 0 {
+		// a lock_timeout of 0 would wait forever
+		timeoutMS := int64(wait / time.Millisecond)
+		if timeoutMS < 1 {
+			timeoutMS = 1
+		}
+
+		_, err = tx.Exec(fmt.Sprintf("SET LOCAL lock_timeout = %d", timeoutMS))
+		if err == nil {
+			_, err = tx.Exec(`SELECT pg_advisory_lock($1, $2::int)`, userSyncLockNamespace, user.ID.Int64)
+			locked = err == nil
+		}
+		// the timeout aborts the transaction, which can only be rolled back
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqLockNotAvailable {
+			tx.Rollback()
+			return nil, errUserLocked
+		}
+	} else {
+		err = tx.Get(&locked, `SELECT pg_try_advisory_lock($1, $2::int)`, userSyncLockNamespace, user.ID.Int64)
+	}
+
+	pid := 0
+	if err == nil && locked {
+		err = tx.Get(&pid, `SELECT pg_backend_pid()`)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	lock := &userLock{db: db, locker: locker, user: user, pid: pid}
+	if err != nil {
+		if locked {
+			lock.unlock()
+		}
+		return nil, err
+	}
+
+	if !locked {
+		return nil, errUserLocked
+	}
+
+	_, err = db.Exec(`UPDATE users SET is_syncing = true WHERE id = $1`, user.ID)
+	if err != nil {
+		lock.unlock()
+		return nil, err
+	}
+
+	user.IsSyncing.Bool, user.IsSyncing.Valid = true, true
+	return lock, nil
+}
+
+// Check fails with errUserLockLost unless the lock is still held, which it
+// no longer is once the connection holding it broke.  It is checked before
+// each stage, as other processes may be syncing the user since.
+func (ul *userLock) Check() error {
+	held := false
+	err := ul.db.Get(&held, `
+		SELECT EXISTS (
+			SELECT 1 FROM pg_locks
+			WHERE locktype = 'advisory' AND classid = $1 AND objid = $2 AND objsubid = 2
+			  AND pid = $3 AND granted
+		)`, userSyncLockNamespace, ul.user.ID.Int64, ul.pid)
+	if err != nil {
+		return err
+	}
+
+	if !held {
+		return errUserLockLost
+	}
+	return nil
+}
+
+func (ul *userLock) Release() error {
+	_, err := ul.db.Exec(`UPDATE users SET is_syncing = false WHERE id = $1`, ul.user.ID)
+	if err != nil {
+		ul.unlock()
+		return err
+	}
+
+	ul.user.IsSyncing.Bool = false
+	return ul.unlock()
+}
+
+func (ul *userLock) unlock() error {
+	_, err := ul.locker.db.Exec(`SELECT pg_advisory_unlock($1, $2::int)`, userSyncLockNamespace, ul.user.ID.Int64)
+	return err
+}
@@ -0,0 +1,68 @@
+package accountsync
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// testDatabaseURL skips tests needing PostgreSQL unless
+// ACCOUNT_SYNC_TEST_DATABASE_URL points at a database to run them against.
+func testDatabaseURL(t *testing.T) string {
+	databaseURL := os.Getenv("ACCOUNT_SYNC_TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("ACCOUNT_SYNC_TEST_DATABASE_URL is not set")
+	}
+	return databaseURL
+}
+
+func TestLockUserWaitsForLockHeldElsewhere(t *testing.T) {
+	databaseURL := testDatabaseURL(t)
+
+	other, err := sqlx.Connect("postgres", databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.SetMaxOpenConns(1)
+
+	locker, err := newUserLocker(databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer locker.Close()
+
+	user := &User{ID: sql.NullInt64{Int64: 4242, Valid: true}}
+
+	_, err = other.Exec(`SELECT pg_advisory_lock($1, $2::int)`, userSyncLockNamespace, user.ID.Int64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Exec(`SELECT pg_advisory_unlock_all()`)
+
+	for _, wait := range []time.Duration{0, 50 * time.Millisecond} {
+		_, err = lockUser(nil, locker, user, wait)
+		if err != errUserLocked {
+			t.Errorf("waiting %v: expected errUserLocked, got %v", wait, err)
+		}
+	}
+
+	_, err = other.Exec(`SELECT pg_advisory_unlock($1, $2::int)`, userSyncLockNamespace, user.ID.Int64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the connection of the locker must be usable again after a failed wait
+	locked := false
+	err = locker.db.Get(&locked, `SELECT pg_try_advisory_lock($1, $2::int)`, userSyncLockNamespace, user.ID.Int64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Error("expected the lock to be free once released elsewhere")
+	}
+	locker.db.Exec(`SELECT pg_advisory_unlock_all()`)
+}
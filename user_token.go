@@ -0,0 +1,356 @@
+package accountsync
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// user tokens are refreshed this long before they expire
+	userTokenExpiryMargin = time.Minute
+
+	// githubBadRefreshToken is the error GitHub answers a refresh with when
+	// the refresh token expired or the user revoked the app's access.
+	githubBadRefreshToken = "bad_refresh_token"
+)
+
+// tokenRefreshError is GitHub refusing to refresh a user's token.
+type tokenRefreshError struct {
+	Status      int
+	Code        string
+	Description string
+}
+
+func (err *tokenRefreshError) Error() string {
+	return fmt.Sprintf("refreshing token failed: status=%v error=%v description=%q",
+		err.Status, err.Code, err.Description)
+}
+
+// tokenRevokedError is returned for a request GitHub rejected the user's
+// token for, when the token could not be refreshed because GitHub refused
+// the refresh token as well.
+type tokenRevokedError struct {
+	Err *tokenRefreshError
+}
+
+func (err *tokenRevokedError) Error() string {
+	return fmt.Sprintf("token rejected and %v", err.Err)
+}
+
+// tokenSource hands out a user's token, refreshing it when it is about to
+// expire or GitHub rejected it, if the user has a refresh token.
+type tokenSource struct {
+	mu        sync.Mutex
+	token     *oauth2.Token
+	refresher *userTokenRefresher
+}
+
+// newUserTokenSource decrypts the stored token of user, which is refreshed
+// when possible.
+func newUserTokenSource(db *DB, cfg *Config, keyring *Keyring, user *User) (*tokenSource, error) {
+	token, err := keyring.Load(user.GithubOauthToken.String)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := &tokenSource{
+		token: &oauth2.Token{
+			AccessToken: token,
+		},
+	}
+
+	if user.GithubOauthTokenExpiresAt != nil {
+		ts.token.Expiry = *user.GithubOauthTokenExpiresAt
+	}
+
+	if user.GithubRefreshToken.Valid && cfg.GithubClientID != "" {
+		ts.refresher = newUserTokenRefresher(db, cfg, keyring, user)
+	}
+
+	return ts, nil
+}
+
+func (ts *tokenSource) Token() (*oauth2.Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.refresher != nil && !ts.token.Expiry.IsZero() &&
+		time.Now().Add(userTokenExpiryMargin).After(ts.token.Expiry) {
+		return ts.refreshLocked()
+	}
+
+	return ts.token, nil
+}
+
+// Transport returns a round tripper authenticating with the token, which
+// retries requests once with a refreshed token when GitHub answers 401.
+func (ts *tokenSource) Transport() http.RoundTripper {
+	return &refreshingTransport{
+		ts:   ts,
+		base: &oauth2.Transport{Source: ts},
+	}
+}
+
+// forceRefresh refreshes the token unless it has already been refreshed
+// since stale was handed out.
+func (ts *tokenSource) forceRefresh(stale string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token.AccessToken != stale {
+		return nil
+	}
+
+	_, err := ts.refreshLocked()
+	return err
+}
+
+func (ts *tokenSource) refreshLocked() (*oauth2.Token, error) {
+	token, err := ts.refresher.Refresh(ts.token)
+	if err != nil {
+		return nil, err
+	}
+
+	ts.token = token
+	return token, nil
+}
+
+func (ts *tokenSource) canRefresh() bool {
+	return ts.refresher != nil
+}
+
+func (ts *tokenSource) currentAccessToken() string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.token.AccessToken
+}
+
+type refreshingTransport struct {
+	ts   *tokenSource
+	base http.RoundTripper
+}
+
+func (rt *refreshingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	stale := rt.ts.currentAccessToken()
+
+	resp, err := rt.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !rt.ts.canRefresh() || req.Body != nil {
+		return resp, err
+	}
+
+	resp.Body.Close()
+	log.Printf("msg=\"refreshing rejected token\" url=%v", req.URL.Path)
+
+	err = rt.ts.forceRefresh(stale)
+	if refreshErr, ok := err.(*tokenRefreshError); ok && refreshErr.Code == githubBadRefreshToken {
+		return nil, &tokenRevokedError{Err: refreshErr}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return rt.base.RoundTrip(req)
+}
+
+func (rt *refreshingTransport) CancelRequest(req *http.Request) {
+	if canceler, ok := rt.base.(requestCanceler); ok {
+		canceler.CancelRequest(req)
+	}
+}
+
+// userTokenRefresher exchanges a user's refresh token for a new pair of
+// tokens and stores them.  The user row is locked while doing so, as a
+// refresh token can only be used once and another process may be syncing
+// the same user.
+type userTokenRefresher struct {
+	db     *DB
+	cfg    *Config
+	col    *Keyring
+	user   *User
+	client *http.Client
+}
+
+func newUserTokenRefresher(db *DB, cfg *Config, col *Keyring, user *User) *userTokenRefresher {
+	return &userTokenRefresher{
+		db:     db,
+		cfg:    cfg,
+		col:    col,
+		user:   user,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (r *userTokenRefresher) Refresh(stale *oauth2.Token) (*oauth2.Token, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	row := struct {
+		Token        sql.NullString `db:"github_oauth_token"`
+		RefreshToken sql.NullString `db:"github_refresh_token"`
+		ExpiresAt    *time.Time     `db:"github_oauth_token_expires_at"`
+	}{}
+
+	err = tx.Get(&row, `
+		SELECT github_oauth_token, github_refresh_token, github_oauth_token_expires_at
+		FROM users
+		WHERE id = $1
+		FOR UPDATE`, r.user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := r.col.Load(row.Token.String)
+	if err != nil {
+		return nil, err
+	}
+
+	if current != stale.AccessToken {
+		log.Printf("msg=\"token already refreshed elsewhere\" login=%v", r.user.Login.String)
+		token := &oauth2.Token{AccessToken: current}
+		if row.ExpiresAt != nil {
+			token.Expiry = *row.ExpiresAt
+		}
+		return token, tx.Commit()
+	}
+
+	refreshToken, err := r.col.Load(row.RefreshToken.String)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("msg=\"refreshing token\" login=%v", r.user.Login.String)
+	token, refreshExpiresAt, err := r.exchange(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var expiresAt *time.Time
+	if !token.Expiry.IsZero() {
+		expiresAt = &token.Expiry
+	}
+
+	encToken, err := r.col.Dump(token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	encRefreshToken, err := r.col.Dump(token.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET github_oauth_token = $1, github_refresh_token = $2,
+		    github_oauth_token_expires_at = $3, github_refresh_token_expires_at = $4
+		WHERE id = $5`, encToken, encRefreshToken, expiresAt, refreshExpiresAt, r.user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	r.user.GithubOauthToken = sql.NullString{String: encToken, Valid: true}
+	r.user.GithubRefreshToken = sql.NullString{String: encRefreshToken, Valid: true}
+	r.user.GithubOauthTokenExpiresAt = expiresAt
+	r.user.GithubRefreshTokenExpiresAt = refreshExpiresAt
+	return token, nil
+}
+
+// exchange trades refreshToken for a new token, which has a zero Expiry when
+// it does not expire, and returns when the new refresh token expires, if
+// it does.
+func (r *userTokenRefresher) exchange(refreshToken string) (*oauth2.Token, *time.Time, error) {
+	form := url.Values{
+		"client_id":     {r.cfg.GithubClientID},
+		"client_secret": {r.cfg.GithubClientSecret},
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	}
+
+	webURL, err := parseBaseURL(r.cfg.GithubWebURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequest("POST", webURL.String()+"login/oauth/access_token",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", githubUserAgent())
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &tokenRefreshError{Status: resp.StatusCode}
+	}
+
+	body := struct {
+		AccessToken           string `json:"access_token"`
+		ExpiresIn             int    `json:"expires_in"`
+		RefreshToken          string `json:"refresh_token"`
+		RefreshTokenExpiresIn int    `json:"refresh_token_expires_in"`
+		TokenType             string `json:"token_type"`
+		Error                 string `json:"error"`
+		ErrorDescription      string `json:"error_description"`
+	}{}
+
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if body.Error != "" {
+		return nil, nil, &tokenRefreshError{Status: resp.StatusCode, Code: body.Error, Description: body.ErrorDescription}
+	}
+	if body.AccessToken == "" {
+		return nil, nil, &tokenRefreshError{Status: resp.StatusCode, Description: "no access token"}
+	}
+
+	now := time.Now().UTC()
+	token := &oauth2.Token{
+		AccessToken:  body.AccessToken,
+		TokenType:    body.TokenType,
+		RefreshToken: body.RefreshToken,
+	}
+	if expiresAt := expiresIn(now, body.ExpiresIn); expiresAt != nil {
+		token.Expiry = *expiresAt
+	}
+
+	return token, expiresIn(now, body.RefreshTokenExpiresIn), nil
+}
+
+// expiresIn is when something valid for seconds from now expires, or nil
+// for an expires_in of zero, which GitHub leaves out for tokens that don't
+// expire.
+func expiresIn(now time.Time, seconds int) *time.Time {
+	if seconds <= 0 {
+		return nil
+	}
+
+	expiresAt := now.Add(time.Duration(seconds) * time.Second)
+	return &expiresAt
+}
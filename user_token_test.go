@@ -0,0 +1,92 @@
+package accountsync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUserTokenRefresherExchange(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		status        int
+		body          string
+		expires       bool
+		refreshExpiry bool
+		code          string
+		fails         bool
+	}{
+		{
+			name:          "expiring",
+			status:        200,
+			body:          `{"access_token":"new","expires_in":28800,"refresh_token":"r","refresh_token_expires_in":15897600}`,
+			expires:       true,
+			refreshExpiry: true,
+		},
+		{
+			name:   "not expiring",
+			status: 200,
+			body:   `{"access_token":"new"}`,
+		},
+		{
+			name:   "zero expiry",
+			status: 200,
+			body:   `{"access_token":"new","expires_in":0,"refresh_token_expires_in":0}`,
+		},
+		{
+			name:   "bad refresh token",
+			status: 200,
+			body:   `{"error":"bad_refresh_token","error_description":"The refresh token passed is incorrect or expired."}`,
+			code:   "bad_refresh_token",
+			fails:  true,
+		},
+		{
+			name:   "no access token",
+			status: 200,
+			body:   `{}`,
+			fails:  true,
+		},
+		{
+			name:   "server error",
+			status: 502,
+			body:   `<html>Bad Gateway</html>`,
+			fails:  true,
+		},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(tc.status)
+			w.Write([]byte(tc.body))
+		}))
+
+		r := &userTokenRefresher{
+			cfg:    &Config{GithubWebURL: server.URL, GithubClientID: "id", GithubClientSecret: "secret"},
+			client: &http.Client{Timeout: time.Second},
+		}
+		token, refreshExpiresAt, err := r.exchange("refresh")
+		server.Close()
+
+		if tc.fails {
+			refreshErr, ok := err.(*tokenRefreshError)
+			if !ok || refreshErr.Status != tc.status || refreshErr.Code != tc.code {
+				t.Errorf("%s: expected a refresh error with status %v and code %q, got %v",
+					tc.name, tc.status, tc.code, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if token.AccessToken != "new" {
+			t.Errorf("%s: expected the new token, got %q", tc.name, token.AccessToken)
+		}
+		if token.Expiry.IsZero() == tc.expires {
+			t.Errorf("%s: expected expiring to be %v, got expiry %v", tc.name, tc.expires, token.Expiry)
+		}
+		if (refreshExpiresAt != nil) != tc.refreshExpiry {
+			t.Errorf("%s: expected refresh token expiring to be %v, got %v", tc.name, tc.refreshExpiry, refreshExpiresAt)
+		}
+	}
+}
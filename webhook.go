@@ -0,0 +1,322 @@
+package accountsync
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+const (
+	webhookMaxPayloadBytes = 25 << 20
+)
+
+var (
+	errMissingWebhookSecret = fmt.Errorf("missing webhook secret")
+	errInvalidSignature     = fmt.Errorf("invalid webhook signature")
+)
+
+type webhookInstallation struct {
+	ID      *int         `json:"id,omitempty"`
+	Account *github.User `json:"account,omitempty"`
+}
+
+type webhookPayload struct {
+	Action       string               `json:"action"`
+	Repository   *GithubRepository    `json:"repository,omitempty"`
+	Organization *github.Organization `json:"organization,omitempty"`
+	Member       *github.User         `json:"member,omitempty"`
+	Membership   *github.Membership   `json:"membership,omitempty"`
+	Installation *webhookInstallation `json:"installation,omitempty"`
+	Sender       *github.User         `json:"sender,omitempty"`
+	Scope        string               `json:"scope,omitempty"`
+}
+
+// WebhookHandler receives GitHub webhooks and applies the changes they
+// describe through the same code paths the syncers use, so that they show
+// up without waiting for the next full sync.
+type WebhookHandler struct {
+	db  *DB
+	cfg *Config
+
+	orgSyncer  *OrganizationSyncer
+	repoSyncer *RepositoriesSyncer
+}
+
+func NewWebhookHandler(cfg *Config) (*WebhookHandler, error) {
+	if cfg.WebhookSecret == "" {
+		return nil, errMissingWebhookSecret
+	}
+
+	log.Println("msg=\"creating database connection\"")
+	db, err := NewDB(cfg.DatabaseURL, cfg.SyncCacheSize, cfg.SyncCacheTTL, cfg.SyncCacheNegativeTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	err = NewMigrator(db).CheckSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookHandler{
+		db:         db,
+		cfg:        cfg,
+		orgSyncer:  NewOrganizationSyncer(db, cfg),
+		repoSyncer: NewRepositoriesSyncer(db, cfg),
+	}, nil
+}
+
+func (wh *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	delivery := r.Header.Get("X-GitHub-Delivery")
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, webhookMaxPayloadBytes))
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+
+	err = wh.verifySignature(r, body)
+	if err != nil {
+		log.Printf("level=warn sync=webhook event=%v delivery=%v err=%v", event, delivery, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	payload := &webhookPayload{}
+	err = json.Unmarshal(body, payload)
+	if err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	started := time.Now().UTC()
+	log.Printf("state=started sync=webhook event=%v action=%v delivery=%v", event, payload.Action, delivery)
+
+	err = wh.handle(event, payload)
+	if err != nil {
+		log.Printf("state=errored sync=webhook event=%v action=%v delivery=%v err=%v",
+			event, payload.Action, delivery, err)
+		http.Error(w, "could not apply webhook", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("state=completed sync=webhook event=%v action=%v delivery=%v duration=%v",
+		event, payload.Action, delivery, time.Now().UTC().Sub(started))
+	incrMetric("webhooks."+event, 1)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (wh *WebhookHandler) verifySignature(r *http.Request, body []byte) error {
+	var (
+		newHash   func() hash.Hash
+		signature string
+	)
+
+	if sig := r.Header.Get("X-Hub-Signature-256"); strings.HasPrefix(sig, "sha256=") {
+		newHash, signature = sha256.New, strings.TrimPrefix(sig, "sha256=")
+	} else if sig := r.Header.Get("X-Hub-Signature"); strings.HasPrefix(sig, "sha1=") {
+		newHash, signature = sha1.New, strings.TrimPrefix(sig, "sha1=")
+	} else {
+		return errInvalidSignature
+	}
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return errInvalidSignature
+	}
+
+	mac := hmac.New(newHash, []byte(wh.cfg.WebhookSecret))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errInvalidSignature
+	}
+
+	return nil
+}
+
+func (wh *WebhookHandler) handle(event string, payload *webhookPayload) error {
+	switch event {
+	case "ping":
+		return nil
+	case "organization":
+		return wh.handleOrganization(payload)
+	case "member":
+		return wh.handleMember(payload)
+	case "membership":
+		return wh.handleMembership(payload)
+	case "repository":
+		return wh.handleRepository(payload)
+	case "installation":
+		return wh.handleInstallation(payload)
+	}
+
+	log.Printf("msg=\"ignoring event\" sync=webhook event=%v action=%v", event, payload.Action)
+	return nil
+}
+
+func (wh *WebhookHandler) handleOrganization(payload *webhookPayload) error {
+	org, err := wh.findOrg(payload.Organization)
+	if err != nil || org == nil {
+		return err
+	}
+
+	switch payload.Action {
+	case "member_added", "member_removed":
+		if payload.Membership == nil {
+			return nil
+		}
+
+		user, err := wh.findUser(payload.Membership.User)
+		if err != nil || user == nil {
+			return err
+		}
+
+		if payload.Action == "member_added" {
+			return wh.orgSyncer.AddMember(org, user)
+		}
+		return wh.orgSyncer.RemoveMember(org, user)
+	case "renamed":
+		return wh.orgSyncer.RenameOrg(org, strPtrOrEmpty(payload.Organization.Login))
+	case "deleted":
+		return wh.orgSyncer.RemoveAllMembers(org)
+	}
+
+	return nil
+}
+
+// handleMember handles collaborators being added to or removed from a
+// repository.  Permissions are not synced yet, so this only makes sure the
+// repository itself is up to date.
+func (wh *WebhookHandler) handleMember(payload *webhookPayload) error {
+	if payload.Repository == nil {
+		return nil
+	}
+	return wh.syncRepository(payload)
+}
+
+// handleMembership handles team memberships.  Being added to a team implies
+// being a member of its org, whereas being removed from one does not imply
+// leaving the org, which is notified by an organization event instead.
+func (wh *WebhookHandler) handleMembership(payload *webhookPayload) error {
+	if payload.Action != "added" || payload.Scope != "team" {
+		return nil
+	}
+
+	org, err := wh.findOrg(payload.Organization)
+	if err != nil || org == nil {
+		return err
+	}
+
+	user, err := wh.findUser(payload.Member)
+	if err != nil || user == nil {
+		return err
+	}
+
+	return wh.orgSyncer.AddMember(org, user)
+}
+
+func (wh *WebhookHandler) handleRepository(payload *webhookPayload) error {
+	if payload.Repository == nil || payload.Repository.ID == nil {
+		return nil
+	}
+
+	if payload.Action == "deleted" {
+		return wh.repoSyncer.MarkRepositoryDeleted(*payload.Repository.ID)
+	}
+
+	return wh.syncRepository(payload)
+}
+
+func (wh *WebhookHandler) handleInstallation(payload *webhookPayload) error {
+	if payload.Installation == nil || payload.Installation.ID == nil {
+		return nil
+	}
+
+	account := payload.Installation.Account
+	if account == nil || account.ID == nil || strPtrOrEmpty(account.Type) != "Organization" {
+		log.Printf("msg=\"ignoring installation on non-organization account\" sync=webhook action=%v",
+			payload.Action)
+		return nil
+	}
+
+	org, err := wh.findOrg(&github.Organization{ID: account.ID, Login: account.Login})
+	if err != nil || org == nil {
+		return err
+	}
+
+	switch payload.Action {
+	case "created":
+		return wh.orgSyncer.SetInstallation(org, *payload.Installation.ID)
+	case "deleted":
+		return wh.orgSyncer.SetInstallation(org, 0)
+	}
+
+	return nil
+}
+
+func (wh *WebhookHandler) syncRepository(payload *webhookPayload) error {
+	sender := &User{}
+	if payload.Sender != nil {
+		user, err := wh.findUser(payload.Sender)
+		if err != nil {
+			return err
+		}
+
+		if user != nil {
+			sender = user
+		} else {
+			sender.Login = sql.NullString{String: strPtrOrEmpty(payload.Sender.Login), Valid: true}
+		}
+	}
+
+	err := wh.repoSyncer.SyncRepository(payload.Repository, sender, nil)
+	if err == errUnknownRepoOwner {
+		log.Printf("msg=\"ignoring repository of unknown owner\" sync=webhook repo=%v",
+			strPtrOrEmpty(payload.Repository.FullName))
+		return nil
+	}
+	return err
+}
+
+func (wh *WebhookHandler) findOrg(ghOrg *github.Organization) (*Organization, error) {
+	if ghOrg == nil || ghOrg.ID == nil {
+		return nil, nil
+	}
+
+	org, err := wh.db.FindOrgByGithubID(*ghOrg.ID)
+	if err == nil && org == nil {
+		log.Printf("msg=\"ignoring unknown org\" sync=webhook org=%v", strPtrOrEmpty(ghOrg.Login))
+	}
+	return org, err
+}
+
+func (wh *WebhookHandler) findUser(ghUser *github.User) (*User, error) {
+	if ghUser == nil || ghUser.ID == nil {
+		return nil, nil
+	}
+
+	user, err := wh.db.FindUserByGithubID(*ghUser.ID)
+	if err == nil && user == nil {
+		log.Printf("level=debug msg=\"ignoring unknown user\" sync=webhook user=%v", strPtrOrEmpty(ghUser.Login))
+	}
+	return user, err
+}
@@ -0,0 +1,82 @@
+package accountsync
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"testing"
+)
+
+func webhookSignature(newHash func() hash.Hash, secret, body string) string {
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookHandlerVerifySignature(t *testing.T) {
+	body := `{"action":"member_added"}`
+
+	for _, tc := range []struct {
+		name    string
+		headers map[string]string
+		err     error
+	}{
+		{
+			name:    "sha256",
+			headers: map[string]string{"X-Hub-Signature-256": "sha256=" + webhookSignature(sha256.New, "secret", body)},
+		},
+		{
+			name:    "sha1",
+			headers: map[string]string{"X-Hub-Signature": "sha1=" + webhookSignature(sha1.New, "secret", body)},
+		},
+		{
+			name: "sha256 preferred over sha1",
+			headers: map[string]string{
+				"X-Hub-Signature-256": "sha256=" + webhookSignature(sha256.New, "secret", body),
+				"X-Hub-Signature":     "sha1=" + webhookSignature(sha1.New, "other", body),
+			},
+		},
+		{
+			name:    "wrong secret",
+			headers: map[string]string{"X-Hub-Signature-256": "sha256=" + webhookSignature(sha256.New, "other", body)},
+			err:     errInvalidSignature,
+		},
+		{
+			name:    "other body",
+			headers: map[string]string{"X-Hub-Signature-256": "sha256=" + webhookSignature(sha256.New, "secret", body+" ")},
+			err:     errInvalidSignature,
+		},
+		{
+			name:    "not hex",
+			headers: map[string]string{"X-Hub-Signature-256": "sha256=zz"},
+			err:     errInvalidSignature,
+		},
+		{
+			name:    "unknown algorithm",
+			headers: map[string]string{"X-Hub-Signature-256": "md5=" + webhookSignature(sha256.New, "secret", body)},
+			err:     errInvalidSignature,
+		},
+		{
+			name:    "unsigned",
+			headers: map[string]string{},
+			err:     errInvalidSignature,
+		},
+	} {
+		wh := &WebhookHandler{cfg: &Config{WebhookSecret: "secret"}}
+		r, err := http.NewRequest("POST", "/webhooks", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+
+		err = wh.verifySignature(r, []byte(body))
+		if err != tc.err {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+}